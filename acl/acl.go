@@ -0,0 +1,153 @@
+// go-multiproxier/acl
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package acl
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "sync/atomic"
+)
+
+// binary trie on address bits, IPv4 lives in the IPv4-mapped range
+type node struct {
+    child [2]*node
+    set bool
+    allow bool
+}
+
+func (n *node)insert(ipnet *net.IPNet, allow bool) {
+    ip := ipnet.IP.To16()
+    ones, bits := ipnet.Mask.Size()
+    if bits == 32 {
+	ones += 96
+    }
+    for i := 0; i < ones; i++ {
+	b := (ip[i / 8] >> uint(7 - i % 8)) & 1
+	if n.child[b] == nil {
+	    n.child[b] = &node{}
+	}
+	n = n.child[b]
+    }
+    // deny wins over allow for the same prefix
+    if n.set && !n.allow {
+	return
+    }
+    n.set = true
+    n.allow = allow
+}
+
+// lookup returns the longest matching prefix
+func (n *node)lookup(ip net.IP) (bool, bool) {
+    found, allow := n.set, n.allow
+    for i := 0; i < 128 && n != nil; i++ {
+	n = n.child[(ip[i / 8] >> uint(7 - i % 8)) & 1]
+	if n != nil && n.set {
+	    found, allow = true, n.allow
+	}
+    }
+    return found, allow
+}
+
+// ACL is a set of allow and deny CIDRs, the longest match decides.
+// An address matching nothing is allowed only if no allow is given.
+type ACL struct {
+    // updated atomically, kept first for 64-bit alignment on 32-bit targets
+    Accepted uint64
+    Denied uint64
+    root node
+    Allows []string
+    Denies []string
+}
+
+func New() *ACL {
+    return &ACL{}
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+    if !strings.Contains(s, "/") {
+	ip := net.ParseIP(s)
+	if ip == nil {
+	    return nil, errors.New("bad address: " + s)
+	}
+	if ip.To4() != nil {
+	    s += "/32"
+	} else {
+	    s += "/128"
+	}
+    }
+    _, n, err := net.ParseCIDR(s)
+    return n, err
+}
+
+func (a *ACL)Allow(cidr string) error {
+    n, err := parseCIDR(cidr)
+    if err != nil {
+	return err
+    }
+    a.root.insert(n, true)
+    a.Allows = append(a.Allows, cidr)
+    return nil
+}
+
+func (a *ACL)Deny(cidr string) error {
+    n, err := parseCIDR(cidr)
+    if err != nil {
+	return err
+    }
+    a.root.insert(n, false)
+    a.Denies = append(a.Denies, cidr)
+    return nil
+}
+
+func (a *ACL)Empty() bool {
+    return len(a.Allows) == 0 && len(a.Denies) == 0
+}
+
+// Check counts the result
+func (a *ACL)Check(ip net.IP) bool {
+    ok := a.Match(ip)
+    if ok {
+	atomic.AddUint64(&a.Accepted, 1)
+    } else {
+	atomic.AddUint64(&a.Denied, 1)
+    }
+    return ok
+}
+
+func (a *ACL)Match(ip net.IP) bool {
+    if a.Empty() {
+	return true
+    }
+    ip = ip.To16()
+    if ip == nil {
+	return false
+    }
+    found, allow := a.root.lookup(ip)
+    if found {
+	return allow
+    }
+    return len(a.Allows) == 0
+}
+
+// CheckAddr passes addresses without IP, unix sockets
+func (a *ACL)CheckAddr(addr net.Addr) bool {
+    if a.Empty() {
+	return true
+    }
+    switch addr := addr.(type) {
+    case *net.TCPAddr:
+	return a.Check(addr.IP)
+    case *net.UDPAddr:
+	return a.Check(addr.IP)
+    }
+    return true
+}
+
+func (a *ACL)Stats() (uint64, uint64) {
+    return atomic.LoadUint64(&a.Accepted), atomic.LoadUint64(&a.Denied)
+}
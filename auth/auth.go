@@ -0,0 +1,173 @@
+// go-multiproxier/auth
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "errors"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+    Name string
+    Hash string
+    Disabled bool
+}
+
+// users file, "name:bcrypt hash[:disabled]" in each line
+type Users struct {
+    path string
+    users map[string]*User
+    // HMAC of the passwords which passed bcrypt, keyed per process
+    key []byte
+    cache map[string][]byte
+    m *sync.Mutex
+}
+
+func Load(path string) (*Users, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+	return nil, err
+    }
+    u := &Users{ path: path, key: key, m: new(sync.Mutex) }
+    if err := u.Reload(); err != nil {
+	return nil, err
+    }
+    return u, nil
+}
+
+func parse(data string) (map[string]*User, error) {
+    users := map[string]*User{}
+    for _, line := range(strings.Split(data, "\n")) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+	    continue
+	}
+	f := strings.Split(line, ":")
+	if len(f) < 2 || f[0] == "" {
+	    return nil, errors.New("bad users line: " + line)
+	}
+	user := &User{ Name: f[0], Hash: f[1] }
+	if len(f) >= 3 && f[2] == "disabled" {
+	    user.Disabled = true
+	}
+	users[user.Name] = user
+    }
+    return users, nil
+}
+
+func (u *Users)Reload() error {
+    data, err := ioutil.ReadFile(u.path)
+    if err != nil {
+	return err
+    }
+    users, err := parse(string(data))
+    if err != nil {
+	return err
+    }
+    u.m.Lock()
+    u.users = users
+    u.cache = map[string][]byte{}
+    u.m.Unlock()
+    return nil
+}
+
+func (u *Users)mac(pass string) []byte {
+    h := hmac.New(sha256.New, u.key)
+    h.Write([]byte(pass))
+    return h.Sum(nil)
+}
+
+func (u *Users)Check(name, pass string) bool {
+    u.m.Lock()
+    user, ok := u.users[name]
+    if !ok || user.Disabled {
+	u.m.Unlock()
+	return false
+    }
+    hash := user.Hash
+    sum, cached := u.cache[name]
+    u.m.Unlock()
+    if cached && subtle.ConstantTimeCompare(sum, u.mac(pass)) == 1 {
+	return true
+    }
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+	return false
+    }
+    u.m.Lock()
+    if u.users[name] == user {
+	u.cache[name] = u.mac(pass)
+    }
+    u.m.Unlock()
+    return true
+}
+
+// save rewrites the user lines of the users file atomically, under lock;
+// comments, order and users unknown to us are kept as they are
+func (u *Users)save() error {
+    data, err := ioutil.ReadFile(u.path)
+    if err != nil {
+	return err
+    }
+    lines := strings.Split(string(data), "\n")
+    for i, line := range(lines) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+	    continue
+	}
+	user, ok := u.users[strings.Split(line, ":")[0]]
+	if !ok {
+	    continue
+	}
+	lines[i] = user.Name + ":" + user.Hash
+	if user.Disabled {
+	    lines[i] += ":disabled"
+	}
+    }
+    tmp := u.path + ".tmp"
+    if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+	return err
+    }
+    return os.Rename(tmp, u.path)
+}
+
+// SetEnabled enables or disables a user and saves the users file
+func (u *Users)SetEnabled(name string, enabled bool) error {
+    u.m.Lock()
+    defer u.m.Unlock()
+    user, ok := u.users[name]
+    if !ok {
+	return errors.New("no such user: " + name)
+    }
+    user.Disabled = !enabled
+    delete(u.cache, name)
+    return u.save()
+}
+
+func (u *Users)Lines() []string {
+    u.m.Lock()
+    defer u.m.Unlock()
+    lines := []string{}
+    for name, user := range(u.users) {
+	st := "enabled"
+	if user.Disabled {
+	    st = "disabled"
+	}
+	lines = append(lines, name + " " + st)
+    }
+    sort.Strings(lines)
+    return lines
+}
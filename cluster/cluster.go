@@ -21,14 +21,84 @@ import (
     "github.com/hshimamoto/go-multiproxier/webhost"
 )
 
+// failure classes, named after RFC 9209 Proxy-Status error types
+const (
+    ErrDestinationUnavailable = "destination_unavailable"
+    ErrConnectionTimeout = "connection_timeout"
+    ErrProxyInternal = "proxy_internal_error"
+)
+
+// Failure describes why no outproxy could serve a connection
+type Failure struct {
+    Class string
+    Tried []string
+    Err error
+}
+
+func (f *Failure)Error() string {
+    return f.Class + ": " + f.Err.Error()
+}
+
+func isTimeout(err error) bool {
+    var e net.Error
+    return errors.As(err, &e) && e.Timeout()
+}
+
+// global limit of concurrent certcheck probes
+type probeLimit struct {
+    cond *sync.Cond
+    running, max int
+}
+
+var probes = &probeLimit{ cond: sync.NewCond(new(sync.Mutex)), max: 4 }
+
+func SetMaxProbes(n int) {
+    if n < 1 {
+	n = 1
+    }
+    probes.cond.L.Lock()
+    probes.max = n
+    probes.cond.L.Unlock()
+    probes.cond.Broadcast()
+}
+
+func MaxProbes() int {
+    probes.cond.L.Lock()
+    defer probes.cond.L.Unlock()
+    return probes.max
+}
+
+func (l *probeLimit)acquire() {
+    l.cond.L.Lock()
+    for l.running >= l.max {
+	l.cond.Wait()
+    }
+    l.running++
+    l.cond.L.Unlock()
+}
+
+func (l *probeLimit)release() {
+    l.cond.L.Lock()
+    l.running--
+    l.cond.L.Unlock()
+    l.cond.Signal()
+}
+
 type Cluster struct {
     Host webhost.WebHost
     CertHost string
     OutProxies *list.List
     CertOK *time.Time
+    Probe *connection.Probe
     m *sync.Mutex
     Expire time.Time
     log *log.LocalLog
+    checking int32
+    // leaf certificate fingerprints seen in certcheck
+    fingerprints map[*outproxy.OutProxy]string
+    suspects map[*outproxy.OutProxy]string
+    history map[string][]Result
+    Stats *Stats
 }
 
 func New() *Cluster {
@@ -36,9 +106,34 @@ func New() *Cluster {
     c.OutProxies = list.New()
     c.m = new(sync.Mutex)
     c.log = log.NewLocalLog(100)
+    c.fingerprints = map[*outproxy.OutProxy]string{}
+    c.suspects = map[*outproxy.OutProxy]string{}
+    c.history = map[string][]Result{}
+    c.Stats = NewStats()
     return c
 }
 
+// Copy returns a cluster to replace cl, it shares the outproxies, logs and
+// stats with cl so that running tunnels keep working
+func (cl *Cluster)Copy() *Cluster {
+    cl.m.Lock()
+    defer cl.m.Unlock()
+    return &Cluster{
+	Host: cl.Host,
+	CertHost: cl.CertHost,
+	OutProxies: cl.OutProxies,
+	CertOK: cl.CertOK,
+	Probe: cl.Probe,
+	m: cl.m,
+	Expire: cl.Expire,
+	log: cl.log,
+	fingerprints: cl.fingerprints,
+	suspects: cl.suspects,
+	history: cl.history,
+	Stats: cl.Stats,
+    }
+}
+
 func (cl *Cluster)String() string {
     return cl.CertHost
 }
@@ -60,16 +155,16 @@ func (cl *Cluster)handleConnectionTry(proxy string, c *connection.Connection, do
 	if err != nil {
 	    if penalty {
 		// 10min.
-		outer.Bad = time.Now().Add(10 * time.Minute)
+		outer.SetBad(10 * time.Minute)
 	    }
 	    return err, !penalty // 1st proxy error is critical
 	}
     } else {
 	// no 1st proxy, just Dial to outproxy
-	pconn, err := net.DialTimeout("tcp", p, outer.Timeout)
+	pconn, err := net.DialTimeout("tcp", p, outer.GetTimeout())
 	if err != nil {
 	    // 10min.
-	    outer.Bad = time.Now().Add(10 * time.Minute)
+	    outer.SetBad(10 * time.Minute)
 	    return err, false
 	}
 	conn = pconn.(*net.TCPConn)
@@ -77,64 +172,99 @@ func (cl *Cluster)handleConnectionTry(proxy string, c *connection.Connection, do
     err, penalty = c.Proc(conn, done, c)
     if err != nil {
 	cl.log.Printf("Connection: %v %v\n", c, err)
+	var v *connection.Verdict
+	if errors.As(err, &v) {
+	    cl.log.Printf("detect %s with %s for %s\n", v.Reason, p, c.Domain())
+	    outer.CountFailure(v.Reason)
+	}
 	conn.Close()
 	if penalty {
-	    outer.Bad = time.Now().Add(10 * time.Minute)
+	    outer.SetBad(10 * time.Minute)
 	}
 	return err, false
     }
     // everything fine
-    outer.Bad = time.Now()
+    outer.SetBad(0)
     atomic.AddInt32(&outer.NumRunning, 1)
     return nil, false
 }
 
-func (cl *Cluster)handleConnection(proxy string, c *connection.Connection) error {
+// handleConnection counts requests in the cluster stats only when count is set
+func (cl *Cluster)handleConnection(proxy string, c *connection.Connection, count bool) error {
     cl.m.Lock()
     e := cl.OutProxies.Front()
+    stats := cl.Stats
     cl.m.Unlock()
+    if !count {
+	stats = NewStats()
+    }
 
+    atomic.AddUint64(&stats.Requests, 1)
     used := [](*outproxy.OutProxy){}
+    tried := []string{}
+    class := ErrDestinationUnavailable
     sentinel := 0
+    candidate := func(outer *outproxy.OutProxy) bool {
+	if !outer.Usable() || cl.suspect(outer) != "" {
+	    return false
+	}
+	if c.Pool() != "" && !outer.InPool(c.Pool()) {
+	    return false
+	}
+	for _, prev := range(used) {
+	    if prev == outer {
+		return false
+	    }
+	}
+	return true
+    }
 
-    for e != nil {
+    for {
+	if e == nil {
+	    // other tunnels reorder the list, it may have passed a candidate
+	    if !cl.any(candidate) {
+		break
+	    }
+	    cl.m.Lock()
+	    e = cl.OutProxies.Front()
+	    cl.m.Unlock()
+	    continue
+	}
 	sentinel++
 	if sentinel > 128 {
 	    cl.log.Printf("something wrong for %s\n", c.Domain())
-	    return errors.New("bad in handleConnection")
+	    return &Failure{Class: ErrProxyInternal, Tried: tried, Err: errors.New("bad in handleConnection")}
 	}
 	outer := e.Value.(*outproxy.OutProxy)
-	if outer.Bad.After(time.Now()) {
+	if !candidate(outer) {
 	    cl.m.Lock()
-	    e = e.Next()
+	    e = cl.next(e)
 	    cl.m.Unlock()
 	    continue
 	}
-	unused := func() bool {
-	    for _, prev := range(used) {
-		if prev == outer {
-		    return false
-		}
-	    }
-	    return true
-	}()
-	if !unused {
-	    cl.m.Lock()
-	    e = e.Next()
-	    cl.m.Unlock()
-	    continue
+	if len(used) > 0 {
+	    atomic.AddUint64(&stats.Failovers, 1)
 	}
+	atomic.AddUint64(&stats.Attempts, 1)
 	used = append(used, outer)
+	tried = append(tried, outer.Addr)
 	done := make(chan bool)
 	c.SetOutProxy(outer)
+	start := time.Now()
 	err, critical := cl.handleConnectionTry(proxy, c, done)
 	if err != nil {
 	    if critical {
 		cl.log.Printf("CRITICAL %v\n", err)
+		class = ErrProxyInternal
 		break
 	    }
+	    if isTimeout(err) {
+		class = ErrConnectionTimeout
+	    } else {
+		class = ErrDestinationUnavailable
+	    }
 	    cl.m.Lock()
-	    next := e.Next()
+	    next := cl.next(e)
 	    cl.OutProxies.MoveToBack(e)
 	    e = next
 	    cl.m.Unlock()
@@ -144,14 +274,19 @@ func (cl *Cluster)handleConnection(proxy string, c *connection.Connection) error
 	cl.m.Lock()
 	cl.OutProxies.MoveToFront(e)
 	cl.m.Unlock()
+	outer.ObserveConnect(time.Since(start))
 	// wait
 	<-done
 	atomic.AddInt32(&outer.NumRunning, -1)
 	atomic.AddUint32(&outer.Success, 1)
+	sent, received := c.Bytes()
+	atomic.AddUint64(&stats.Sent, uint64(sent))
+	atomic.AddUint64(&stats.Received, uint64(received))
 	return nil
     }
+    atomic.AddUint64(&stats.Failures, 1)
     cl.log.Printf("ERR No proxy found for %s\n", c.Domain())
-    return errors.New("No good proxy")
+    return &Failure{Class: class, Tried: tried, Err: errors.New("No good proxy")}
 }
 
 func (cl *Cluster)handleConnectionCert(proxy string) {
@@ -168,6 +303,11 @@ func (cl *Cluster)handleConnectionCert(proxy string) {
     cl.Unlock()
 
     var wg sync.WaitGroup
+    var m sync.Mutex
+    probed := [](*outproxy.OutProxy){}
+    fingerprints := map[*outproxy.OutProxy]string{}
+    issuers := map[*outproxy.OutProxy]string{}
+    suspects := map[*outproxy.OutProxy]string{}
 
     cl.log.Printf("check %d proxies\n", len(success))
     for idx, e := range success {
@@ -178,18 +318,35 @@ func (cl *Cluster)handleConnectionCert(proxy string) {
 	go func() {
 	    defer wg.Done()
 
-	    if outer.Bad.After(time.Now()) {
+	    if !outer.Usable() {
 		return
 	    }
+	    probes.acquire()
+	    defer probes.release()
 	    done := make(chan bool)
 	    c := connection.New(cl.CertHost, nil, nil, certcheckThisConn, cl.log)
+	    c.SetProbe(cl.Probe)
 	    c.SetOutProxy(outer)
+	    start := time.Now()
 	    err, _ := cl.handleConnectionTry(proxy, c, done)
+	    cl.record(outer.Addr, start, c, err)
+	    m.Lock()
+	    probed = append(probed, outer)
+	    if c.Fingerprint() != "" {
+		fingerprints[outer] = c.Fingerprint()
+		issuers[outer] = c.Issuer()
+	    }
 	    if err != nil {
+		var pe *connection.PinError
+		if errors.As(err, &pe) {
+		    suspects[outer] = pe.Reason
+		}
 		fail = append(fail, elm)
+		m.Unlock()
 		atomic.AddUint32(&outer.Fail, 1)
 		return
 	    }
+	    m.Unlock()
 	    <-done
 	    atomic.AddInt32(&outer.NumRunning, -1)
 	    atomic.AddUint32(&outer.Success, 1)
@@ -198,11 +355,134 @@ func (cl *Cluster)handleConnectionCert(proxy string) {
 
     wg.Wait()
 
+    // the CA most outproxies see is the genuine one, the leaves may
+    // differ among CDN servers
+    count := map[string]int{}
+    for _, ik := range(issuers) {
+	count[ik]++
+    }
+    major := ""
+    for ik, n := range(count) {
+	if n * 2 > len(issuers) {
+	    major = ik
+	}
+    }
+    if major != "" {
+	for outer, ik := range(issuers) {
+	    if ik != major && suspects[outer] == "" {
+		suspects[outer] = "issuer " + ik + " differs from " + major
+	    }
+	}
+    }
+
     cl.m.Lock()
     for _, e := range fail {
 	cl.OutProxies.MoveToBack(e)
     }
+    for _, outer := range(probed) {
+	delete(cl.suspects, outer)
+    }
+    for outer, fp := range(fingerprints) {
+	cl.fingerprints[outer] = fp
+    }
+    for outer, reason := range(suspects) {
+	cl.suspects[outer] = reason
+	if e := cl.element(outer); e != nil {
+	    cl.OutProxies.MoveToBack(e)
+	}
+    }
+    cl.m.Unlock()
+    for outer, reason := range(suspects) {
+	cl.log.Printf("MITM suspected %s for %s: %s\n", outer.Addr, cl.CertHost, reason)
+    }
+}
+
+// under lock
+func (cl *Cluster)element(outer *outproxy.OutProxy) *list.Element {
+    for e := cl.OutProxies.Front(); e != nil; e = e.Next() {
+	if e.Value.(*outproxy.OutProxy) == outer {
+	    return e
+	}
+    }
+    return nil
+}
+
+// next returns the element after e, or the front when Remove has unlinked e,
+// under cl.m
+func (cl *Cluster)next(e *list.Element) *list.Element {
+    if n := e.Next(); n != nil || cl.OutProxies.Back() == e {
+	return n
+    }
+    return cl.OutProxies.Front()
+}
+
+// any reports whether f holds for an outproxy in cl
+func (cl *Cluster)any(f func(*outproxy.OutProxy) bool) bool {
+    cl.m.Lock()
+    outers := [](*outproxy.OutProxy){}
+    for e := cl.OutProxies.Front(); e != nil; e = e.Next() {
+	outers = append(outers, e.Value.(*outproxy.OutProxy))
+    }
     cl.m.Unlock()
+    for _, outer := range(outers) {
+	if f(outer) {
+	    return true
+	}
+    }
+    return false
+}
+
+// Add appends outer unless it is there already
+func (cl *Cluster)Add(outer *outproxy.OutProxy) bool {
+    cl.m.Lock()
+    defer cl.m.Unlock()
+    if cl.element(outer) != nil {
+	return false
+    }
+    cl.OutProxies.PushBack(outer)
+    return true
+}
+
+// Remove drops outer, tunnels through it keep running and attempts
+// walking the list go on from the front
+func (cl *Cluster)Remove(outer *outproxy.OutProxy) bool {
+    cl.m.Lock()
+    defer cl.m.Unlock()
+    delete(cl.fingerprints, outer)
+    delete(cl.suspects, outer)
+    delete(cl.history, outer.Addr)
+    e := cl.element(outer)
+    if e == nil {
+	return false
+    }
+    cl.OutProxies.Remove(e)
+    return true
+}
+
+func (cl *Cluster)suspect(outer *outproxy.OutProxy) string {
+    cl.m.Lock()
+    defer cl.m.Unlock()
+    return cl.suspects[outer]
+}
+
+// Certs returns observed fingerprints per outproxy
+func (cl *Cluster)Certs() []string {
+    lines := []string{}
+    cl.m.Lock()
+    for e := cl.OutProxies.Front(); e != nil; e = e.Next() {
+	outer := e.Value.(*outproxy.OutProxy)
+	fp, ok := cl.fingerprints[outer]
+	if !ok {
+	    fp = "-"
+	}
+	line := outer.Addr + " " + fp
+	if reason, ok := cl.suspects[outer]; ok {
+	    line += " suspect: " + reason
+	}
+	lines = append(lines, line)
+    }
+    cl.m.Unlock()
+    return lines
 }
 
 func (cl *Cluster)Lock() {
@@ -222,11 +502,19 @@ func tryThisConn(conn net.Conn, done chan bool, c *connection.Connection) (error
 }
 
 func (cl *Cluster)CertCheck(proxy string) {
+    if !atomic.CompareAndSwapInt32(&cl.checking, 0, 1) {
+	cl.log.Printf("Skip CertCheck %s cluster: already running\n", cl.CertHost)
+	return
+    }
+    defer atomic.StoreInt32(&cl.checking, 0)
     cl.log.Printf("Start CertCheck %s cluster: %v\n", cl.CertHost, cl)
     cl.handleConnectionCert(proxy)
     cl.log.Printf("All proxies were checked %s cluster: %v\n", cl.CertHost, cl)
     conn := connection.New(cl.CertHost, nil, nil, certcheckThisConn, cl.log)
-    err := cl.handleConnection(proxy, conn)
+    conn.SetProbe(cl.Probe)
+    probes.acquire()
+    err := cl.handleConnection(proxy, conn, false)
+    probes.release()
     if err != nil {
 	cl.CertOK = nil
 	cl.log.Printf("Fail CertCheck %s cluster: %v\n", cl.CertHost, cl)
@@ -237,11 +525,24 @@ func (cl *Cluster)CertCheck(proxy string) {
     cl.log.Printf("Done CertCheck %s cluster: %v\n", cl.CertHost, cl)
 }
 
-func (cl *Cluster)Run(proxy, host string, w http.ResponseWriter,r *http.Request) {
+// RunConn is Run for a client connection without HTTP CONNECT
+func (cl *Cluster)RunConn(proxy, host, port, pool string, lconn net.Conn, preread []byte, ready func()) (*Tunnel, error) {
+    conn := connection.NewConn(host, port, lconn, preread, tryThisConn, cl.log)
+    conn.SetReady(ready)
+    conn.SetPool(pool)
+    if err := cl.handleConnection(proxy, conn, true); err != nil {
+	return nil, err
+    }
+    return cl.tunnel(conn), nil
+}
+
+// Run returns *Failure when the connection could not be established,
+// only outproxies in pool are used unless pool is empty
+func (cl *Cluster)Run(proxy, host, pool string, w http.ResponseWriter,r *http.Request) (*Tunnel, error) {
     conn := connection.New(host, r, w, tryThisConn, cl.log)
-    err := cl.handleConnection(proxy, conn)
-    if err != nil {
-	// TODO: do something?
-	w.WriteHeader(http.StatusForbidden)
+    conn.SetPool(pool)
+    if err := cl.handleConnection(proxy, conn, true); err != nil {
+	return nil, err
     }
+    return cl.tunnel(conn), nil
 }
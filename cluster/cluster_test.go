@@ -0,0 +1,250 @@
+// go-multiproxier/cluster / cluster_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package cluster
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/outproxy"
+)
+
+// fakeMiddle is a middle proxy, "dead:N" outproxies refuse the first
+// CONNECT, "deny:N" ones refuse the second, others echo 5 bytes back
+func fakeMiddle(t *testing.T) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+    readConnect := func(br *bufio.Reader) (string, bool) {
+	first := ""
+	for {
+	    s, err := br.ReadString('\n')
+	    if err != nil {
+		return "", false
+	    }
+	    if first == "" {
+		first = s
+	    }
+	    if s == "\r\n" {
+		return first, true
+	    }
+	}
+    }
+    go func() {
+	for {
+	    c, err := l.Accept()
+	    if err != nil {
+		return
+	    }
+	    go func(c net.Conn) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, ok := readConnect(br)
+		if !ok {
+		    return
+		}
+		if strings.Contains(req, "dead:") {
+		    c.Write([]byte("HTTP/1.0 502 Bad Gateway\r\n\r\n"))
+		    return
+		}
+		c.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		if _, ok := readConnect(br); !ok {
+		    return
+		}
+		if strings.Contains(req, "deny:") {
+		    c.Write([]byte("HTTP/1.0 403 Forbidden\r\n\r\n"))
+		    return
+		}
+		c.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(br, buf); err != nil {
+		    return
+		}
+		c.Write(buf)
+	    }(c)
+	}
+    }()
+    return l.Addr().String()
+}
+
+func newOutProxy(addr string) *outproxy.OutProxy {
+    return &outproxy.OutProxy{ Addr: addr, Bad: time.Now(), Timeout: 5 * time.Second }
+}
+
+// connPair returns both ends of a TCP connection
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer l.Close()
+    a, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+	t.Fatal(err)
+    }
+    b, err := l.Accept()
+    if err != nil {
+	t.Fatal(err)
+    }
+    return a, b
+}
+
+func TestConcurrentHandleConnection(t *testing.T) {
+    middle := fakeMiddle(t)
+    dead := newOutProxy("dead:1")
+    deny := newOutProxy("deny:1")
+    good := newOutProxy("good:1")
+    cl := New()
+    cl.CertHost = "example.com"
+    cl.OutProxies.PushBack(dead)
+    cl.OutProxies.PushBack(deny)
+    cl.OutProxies.PushBack(good)
+
+    // outproxies come and go while tunnels walk the list
+    stop := make(chan struct{})
+    churned := make(chan struct{})
+    go func() {
+	defer close(churned)
+	extra := newOutProxy("deny:2")
+	for {
+	    select {
+	    case <-stop:
+		return
+	    default:
+	    }
+	    cl.Add(extra)
+	    cl.Remove(extra)
+	}
+    }()
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 32)
+    for i := 0; i < 32; i++ {
+	wg.Add(1)
+	go func() {
+	    defer wg.Done()
+	    client, lconn := connPair(t)
+	    defer client.Close()
+	    go func() {
+		client.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		io.ReadFull(client, buf)
+		client.Close()
+	    }()
+	    _, err := cl.RunConn(middle, "example.com", "443", "", lconn, nil, nil)
+	    errs <- err
+	}()
+	// the Lines and reordering race with the tunnels
+	go cl.Certs()
+    }
+    wg.Wait()
+    close(stop)
+    <-churned
+    close(errs)
+    for err := range(errs) {
+	if err != nil {
+	    t.Errorf("RunConn: %v", err)
+	}
+    }
+    if !dead.IsBad() {
+	t.Errorf("dead outproxy is not bad")
+    }
+    if deny.IsBad() {
+	t.Errorf("deny outproxy is bad, it was the destination")
+    }
+    if n := good.Success; n != 32 {
+	t.Errorf("good success %d, want 32", n)
+    }
+    cl.Lock()
+    front := cl.OutProxies.Front().Value.(*outproxy.OutProxy)
+    cl.Unlock()
+    if front != good {
+	t.Errorf("front is %s, want %s", front.Addr, good.Addr)
+    }
+}
+
+func TestBadRecover(t *testing.T) {
+    middle := fakeMiddle(t)
+    o := newOutProxy("good:2")
+    cl := New()
+    cl.CertHost = "example.com"
+    cl.OutProxies.PushBack(o)
+
+    o.SetBad(time.Minute)
+    client, lconn := connPair(t)
+    defer client.Close()
+    if _, err := cl.RunConn(middle, "example.com", "443", "", lconn, nil, nil); err == nil {
+	t.Fatalf("bad outproxy was used")
+    }
+    lconn.Close()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 16; i++ {
+	wg.Add(2)
+	go func() {
+	    defer wg.Done()
+	    o.SetBad(time.Minute)
+	    o.SetBad(0)
+	}()
+	go func() {
+	    defer wg.Done()
+	    o.Usable()
+	    o.Line()
+	}()
+    }
+    wg.Wait()
+
+    client, lconn = connPair(t)
+    defer client.Close()
+    go func() {
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	io.ReadFull(client, buf)
+	client.Close()
+    }()
+    if _, err := cl.RunConn(middle, "example.com", "443", "", lconn, nil, nil); err != nil {
+	t.Fatalf("recovered outproxy: %v", err)
+    }
+}
+
+func TestCertCheckStats(t *testing.T) {
+    middle := fakeMiddle(t)
+    cl := New()
+    cl.CertHost = "example.com"
+    cl.OutProxies.PushBack(newOutProxy("good:3"))
+
+    // the echo is no TLS server, the check fails but is not a request
+    cl.CertCheck(middle)
+    if n := cl.Stats.Requests; n != 0 {
+	t.Errorf("requests %d after certcheck, want 0", n)
+    }
+    if n := cl.Stats.Attempts; n != 0 {
+	t.Errorf("attempts %d after certcheck, want 0", n)
+    }
+
+    client, lconn := connPair(t)
+    defer client.Close()
+    go func() {
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	io.ReadFull(client, buf)
+	client.Close()
+    }()
+    if _, err := cl.RunConn(middle, "example.com", "443", "", lconn, nil, nil); err != nil {
+	t.Fatalf("RunConn: %v", err)
+    }
+    if n := cl.Stats.Requests; n != 1 {
+	t.Errorf("requests %d, want 1", n)
+    }
+}
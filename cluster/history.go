@@ -0,0 +1,80 @@
+// go-multiproxier/cluster / history.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package cluster
+
+import (
+    "errors"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/connection"
+)
+
+// number of certcheck results kept per outproxy
+const HistoryLen = 16
+
+// certcheck result
+type Result struct {
+    Time time.Time `json:"time"`
+    Latency float64 `json:"latency_ms"`
+    Class string `json:"class"`
+    Status int `json:"status,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+// classify certcheck outcome
+func resultClass(c *connection.Connection, err error) string {
+    if err == nil {
+	return "ok"
+    }
+    var v *connection.Verdict
+    if errors.As(err, &v) {
+	return "blocked"
+    }
+    var pe *connection.PinError
+    if errors.As(err, &pe) {
+	return "mitm"
+    }
+    if isTimeout(err) {
+	return "timeout"
+    }
+    if c.Step() == "" {
+	return "proxy"
+    }
+    return c.Step()
+}
+
+func (cl *Cluster)record(addr string, start time.Time, c *connection.Connection, err error) {
+    r := Result{
+	Time: start,
+	Latency: float64(time.Since(start)) / float64(time.Millisecond),
+	Class: resultClass(c, err),
+	Status: c.Status(),
+    }
+    if err != nil {
+	r.Error = err.Error()
+    }
+    cl.m.Lock()
+    h := append(cl.history[addr], r)
+    if len(h) > HistoryLen {
+	h = h[len(h) - HistoryLen:]
+    }
+    cl.history[addr] = h
+    stats := cl.Stats
+    cl.m.Unlock()
+    stats.countCheck(r.Class)
+}
+
+// History returns certcheck results by outproxy address, oldest first
+func (cl *Cluster)History() map[string][]Result {
+    cl.m.Lock()
+    defer cl.m.Unlock()
+    hist := map[string][]Result{}
+    for addr, h := range(cl.history) {
+	hist[addr] = append([]Result{}, h...)
+    }
+    return hist
+}
@@ -0,0 +1,43 @@
+// go-multiproxier/cluster / stats.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package cluster
+
+import (
+    "sync"
+)
+
+// Stats are counters for metrics, temp clusters share one
+type Stats struct {
+    Requests uint64
+    Attempts uint64
+    Failovers uint64
+    Failures uint64
+    Sent uint64
+    Received uint64
+    checks map[string]uint64 // certcheck results by class
+    m sync.Mutex
+}
+
+func NewStats() *Stats {
+    return &Stats{ checks: map[string]uint64{} }
+}
+
+func (s *Stats)countCheck(class string) {
+    s.m.Lock()
+    s.checks[class]++
+    s.m.Unlock()
+}
+
+func (s *Stats)Checks() map[string]uint64 {
+    s.m.Lock()
+    defer s.m.Unlock()
+    checks := map[string]uint64{}
+    for k, v := range(s.checks) {
+	checks[k] = v
+    }
+    return checks
+}
@@ -0,0 +1,41 @@
+// go-multiproxier/cluster / tunnel.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package cluster
+
+import (
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/connection"
+)
+
+// Tunnel is a finished client tunnel
+type Tunnel struct {
+    Cluster string
+    OutProxy string
+    Host string
+    Sent int64
+    Received int64
+    Duration time.Duration
+}
+
+func (cl *Cluster)tunnel(c *connection.Connection) *Tunnel {
+    sent, received := c.Bytes()
+    cl.m.Lock()
+    name := cl.CertHost
+    cl.m.Unlock()
+    t := &Tunnel{
+	Cluster: name,
+	Host: c.Domain(),
+	Sent: sent,
+	Received: received,
+	Duration: c.Duration(),
+    }
+    if o := c.GetOutProxy(); o != nil {
+	t.OutProxy = o.Addr
+    }
+    return t
+}
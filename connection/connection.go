@@ -7,6 +7,7 @@
 package connection
 
 import (
+    "bufio"
     "crypto/tls"
     "fmt"
     "io"
@@ -19,22 +20,47 @@ import (
     "github.com/hshimamoto/go-multiproxier/outproxy"
 )
 
-func Transfer(lconn, rconn net.Conn) {
+// closeWrite passes EOF on to the peer of conn if it can
+func closeWrite(conn net.Conn) {
+    if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+	cw.CloseWrite()
+    }
+}
+
+// Transfer returns bytes from lconn to rconn and from rconn to lconn,
+// both conns are closed on return
+func Transfer(lconn, rconn net.Conn) (int64, int64) {
+    var sent, received int64
     d1 := make(chan bool)
     d2 := make(chan bool)
     go func() {
-	io.Copy(rconn, lconn)
-	d1 <- true
+	sent, _ = io.Copy(rconn, lconn)
+	closeWrite(rconn)
+	close(d1)
     }()
     go func() {
-	io.Copy(lconn, rconn)
-	d2 <- true
+	received, _ = io.Copy(lconn, rconn)
+	closeWrite(lconn)
+	close(d2)
     }()
+    // give the other direction a second to finish
     select {
-    case <-d1: go func() { <-d2 }()
-    case <-d2: go func() { <-d1 }()
+    case <-d1:
+	select {
+	case <-d2:
+	case <-time.After(time.Second):
+	}
+    case <-d2:
+	select {
+	case <-d1:
+	case <-time.After(time.Second):
+	}
     }
-    time.Sleep(time.Second)
+    lconn.Close()
+    rconn.Close()
+    <-d1
+    <-d2
+    return sent, received
 }
 
 var timeout time.Duration = 10 * time.Second
@@ -60,12 +86,11 @@ func OpenProxy(proxy, outproxy string) (net.Conn, error, bool) {
     n, err := conn.Read(buf) // expect 200 OK
     if err != nil || n == 0 {
 	conn.Close()
-	if err != nil {
-	    log.Println("proxy Read fail:", err)
-	} else {
-	    log.Println("proxy closed")
+	if err == nil {
+	    err = io.ErrUnexpectedEOF
 	}
-	return nil, fmt.Errorf("READ NG"), true
+	log.Println("proxy Read fail:", err)
+	return nil, fmt.Errorf("READ NG: %w", err), true
     }
     err = CheckConnectOK(string(buf[:n]))
     if err != nil {
@@ -81,6 +106,20 @@ type Connection struct {
     w http.ResponseWriter
     Proc ConnectionProc
     outproxy *outproxy.OutProxy
+    pool string
+    probe *Probe
+    fingerprint string
+    issuer string
+    step string
+    status int
+    // accepted client which is already answered
+    port string
+    lconn net.Conn
+    preread []byte
+    ready func()
+    // tunnel bytes
+    sent, received int64
+    started, finished time.Time
     log *log.LocalLog
 }
 
@@ -89,9 +128,22 @@ func New(domain string, r *http.Request, w http.ResponseWriter, proc ConnectionP
     return c
 }
 
+// NewConn is for a client connection without HTTP CONNECT, preread is
+// sent to the server first
+func NewConn(domain, port string, lconn net.Conn, preread []byte, proc ConnectionProc, log *log.LocalLog) *Connection {
+    c := &Connection{ domain: domain, port: port, lconn: lconn, preread: preread, Proc: proc, log: log }
+    return c
+}
+
+// SetReady sets the callback for a client without HTTP CONNECT, it is
+// called when the tunnel is established
+func (c *Connection)SetReady(ready func()) {
+    c.ready = ready
+}
+
 func (c *Connection)String() string {
     t := "Normal"
-    if c.w == nil {
+    if c.w == nil && c.lconn == nil {
 	t = "CertCheck"
     }
     return t + " for " + c.domain
@@ -113,6 +165,15 @@ func (c *Connection)Domain() string {
     return c.domain
 }
 
+// SetPool limits outproxies to the pool
+func (c *Connection)SetPool(pool string) {
+    c.pool = pool
+}
+
+func (c *Connection)Pool() string {
+    return c.pool
+}
+
 func (c *Connection)GetOutProxy() *outproxy.OutProxy {
     return c.outproxy
 }
@@ -121,43 +182,43 @@ func (c *Connection)SetOutProxy(o *outproxy.OutProxy) {
     c.outproxy = o
 }
 
-func (c *Connection)CheckGoogle(conn net.Conn, client *tls.Conn, done chan bool) (error, bool) {
-    outer := c.GetOutProxy()
+func (c *Connection)SetProbe(p *Probe) {
+    c.probe = p
+}
 
-    getreq := "GET /search?source=hp&q=proxy HTTP/1.1\r\n"
-    getreq += "Host: www.google.com\r\n"
-    getreq += "User-Agent: Mozilla/5.0 Gecko/20100101 Firefox/61.0\r\n"
-    getreq += "Accept: */*\r\n"
-    getreq += "\r\n"
-    client.Write([]byte(getreq))
-
-    buf := make([]byte, 4096)
-    client.SetReadDeadline(time.Now().Add(outer.Timeout))
-    n, err := client.Read(buf)
-    if n > 0 {
-	resp := string(buf[:n])
-	if strings.Index(resp, `https://www.google.com/sorry/index?continue`) > 0 {
-	    return fmt.Errorf("Google detect with %s", outer.Addr), false
-	}
-    } else {
-	if err != nil {
-	    return fmt.Errorf("waiting GET / response %v", err), false
-	}
-	return fmt.Errorf("remote TLS connection closed"), false
-    }
+// Step returns the last step CertCheck reached, connect, tls or http
+func (c *Connection)Step() string {
+    return c.step
+}
 
-    // send done in background
-    go func() {
-	defer conn.Close()
-	c.log.Printf("certcheck ok for %s with %s\n", c.Domain(), outer.Addr)
-	done <- true
-    }()
+// Status returns the HTTP status of the probe
+func (c *Connection)Status() int {
+    return c.status
+}
 
-    return nil, false
+// Bytes returns bytes sent and received in the tunnel, valid after done
+func (c *Connection)Bytes() (int64, int64) {
+    return c.sent, c.received
+}
+
+// Duration returns how long the tunnel lived, valid after done
+func (c *Connection)Duration() time.Duration {
+    return c.finished.Sub(c.started)
+}
+
+// Fingerprint returns the leaf certificate fingerprint seen in CertCheck
+func (c *Connection)Fingerprint() string {
+    return c.fingerprint
+}
+
+// Issuer returns IssuerKey of the certificates seen in CertCheck
+func (c *Connection)Issuer() string {
+    return c.issuer
 }
 
 func (c *Connection)CertCheck(conn net.Conn, done chan bool) (error, bool) {
     outer := c.GetOutProxy()
+    c.step = "connect"
     msg := "CONNECT " + c.Domain() + ":443 HTTP/1.0\r\n\r\n"
     conn.Write([]byte(msg))
     buf, err := outer.CheckConnect(conn, "certcheckThisConn")
@@ -171,6 +232,7 @@ func (c *Connection)CertCheck(conn net.Conn, done chan bool) (error, bool) {
 
     c.log.Printf("start certcheck communication for %s with %s\n", c.Domain(), outer.Addr)
 
+    c.step = "tls"
     client := tls.Client(conn, &tls.Config{ ServerName: c.Domain() })
     defer client.Close()
 
@@ -178,32 +240,34 @@ func (c *Connection)CertCheck(conn net.Conn, done chan bool) (error, bool) {
     if err != nil {
 	return err, false // no penalty
     }
-    c.log.Printf("TLS cert ok for %s with %s\n", c.Domain(), outer.Addr)
-
-    if c.Domain() == "www.google.com" {
-	return c.CheckGoogle(conn, client, done)
+    probe := c.probe
+    if probe == nil {
+	probe = DefaultProbe(c.Domain())
+    }
+    st := client.ConnectionState()
+    if len(st.PeerCertificates) > 0 {
+	c.fingerprint = Fingerprint(st.PeerCertificates[0])
+    }
+    c.issuer = IssuerKey(st.VerifiedChains)
+    err = probe.CheckCerts(st.VerifiedChains)
+    if err != nil {
+	return fmt.Errorf("%w with %s", err, outer.Addr), false
     }
+    c.log.Printf("TLS cert ok for %s with %s\n", c.Domain(), outer.Addr)
 
-    getreq := "GET / HTTP/1.1\r\n"
-    getreq += "Host: " + c.Domain() + "\r\n"
-    getreq += "User-Agent: curl/7.58.0\r\n"
-    getreq += "Accept: */*\r\n"
-    getreq += "\r\n"
-    client.Write([]byte(getreq))
+    c.step = "http"
+    client.Write([]byte(probe.Request(c.Domain())))
 
-    buf = make([]byte, 4096)
-    client.SetReadDeadline(time.Now().Add(outer.Timeout))
-    n, err := client.Read(buf)
-    if n > 0 {
-	resp := string(buf[:n])
-	if strings.Index(resp, `<title>Attention Required! | Cloudflare</title>`) > 0 {
-	    return fmt.Errorf("Cloudflare detect with %s", outer.Addr), false
-	}
-    } else {
-	if err != nil {
-	    return fmt.Errorf("waiting GET / response %v", err), false
-	}
-	return fmt.Errorf("remote TLS connection closed"), false
+    client.SetReadDeadline(time.Now().Add(outer.GetTimeout()))
+    rd := bufio.NewReader(client)
+    resp, err := http.ReadResponse(rd, &http.Request{ Method: probe.Method })
+    if err != nil {
+	return fmt.Errorf("waiting probe response %w", err), false
+    }
+    c.status = resp.StatusCode
+    err = probe.Check(NewResponse(resp))
+    if err != nil {
+	return fmt.Errorf("probe %w with %s", err, outer.Addr), false
     }
 
     // send done in background
@@ -218,8 +282,12 @@ func (c *Connection)CertCheck(conn net.Conn, done chan bool) (error, bool) {
 
 func (c *Connection)Run(conn net.Conn, done chan bool) (error, bool) {
     outer := c.GetOutProxy()
-    // send original CONNECT
-    c.ReqWriteProxy(conn)
+    if c.r != nil {
+	// send original CONNECT
+	c.ReqWriteProxy(conn)
+    } else {
+	conn.Write([]byte("CONNECT " + net.JoinHostPort(c.domain, c.port) + " HTTP/1.0\r\n\r\n"))
+    }
     buf, err := outer.CheckConnect(conn, "tryThisConn")
     if err != nil {
 	return err, true
@@ -233,13 +301,30 @@ func (c *Connection)Run(conn net.Conn, done chan bool) (error, bool) {
 
     go func() {
 	defer conn.Close()
-	// start hijacking
-	lconn := c.Hijack()
+	lconn := c.lconn
+	extra := int64(0)
+	if lconn == nil {
+	    // start hijacking
+	    lconn = c.Hijack()
+	    lconn.Write(buf)
+	} else {
+	    if c.ready != nil {
+		c.ready()
+	    }
+	    // the client got its answer, pass data after the response header
+	    if idx := strings.Index(string(buf), "\r\n\r\n"); idx >= 0 {
+		n, _ := lconn.Write(buf[idx+4:])
+		extra = int64(n)
+	    }
+	    conn.Write(c.preread)
+	}
 	defer lconn.Close()
 
-	lconn.Write(buf)
-
-	Transfer(lconn, conn)
+	c.started = time.Now()
+	c.sent, c.received = Transfer(lconn, conn)
+	c.finished = time.Now()
+	c.sent += int64(len(c.preread))
+	c.received += extra
 
 	c.log.Printf("done communication for %s\n", c.Domain())
 
@@ -0,0 +1,54 @@
+// go-multiproxier/connection / connection_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package connection
+
+import (
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer l.Close()
+    a, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+	t.Fatal(err)
+    }
+    b, err := l.Accept()
+    if err != nil {
+	t.Fatal(err)
+    }
+    return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+func TestTransferLateDirection(t *testing.T) {
+    client, lconn := tcpPair(t)
+    rconn, server := tcpPair(t)
+    defer client.Close()
+    defer server.Close()
+    go func() {
+	// the request ends at once, the answer comes later
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	io.Copy(io.Discard, client)
+    }()
+    go func() {
+	io.Copy(io.Discard, server)
+	time.Sleep(200 * time.Millisecond)
+	server.Write([]byte("late answer"))
+	server.Close()
+    }()
+    sent, received := Transfer(lconn, rconn)
+    if sent != 7 || received != 11 {
+	t.Errorf("Transfer got %d %d, want 7 11", sent, received)
+    }
+}
@@ -0,0 +1,167 @@
+// go-multiproxier/connection / detector.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package connection
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// probe response seen by detectors
+type Response struct {
+    Status int
+    Header http.Header
+    Body []byte // prefix
+    Raw []byte // status line, headers and Body
+}
+
+// NewResponse reads the body prefix of resp
+func NewResponse(resp *http.Response) *Response {
+    var raw bytes.Buffer
+    fmt.Fprintf(&raw, "%s %s\r\n", resp.Proto, resp.Status)
+    resp.Header.Write(&raw)
+    raw.WriteString("\r\n")
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+    raw.Write(body)
+    return &Response{
+	Status: resp.StatusCode,
+	Header: resp.Header,
+	Body: body,
+	Raw: raw.Bytes(),
+    }
+}
+
+// Verdict is an error when Blocked
+type Verdict struct {
+    Blocked bool
+    Reason string
+}
+
+func (v *Verdict)Error() string {
+    return "blocked by " + v.Reason
+}
+
+// block page detector
+type Detector interface {
+    Name() string
+    Detect(resp *Response) Verdict
+}
+
+var detectors = []Detector{}
+var detectorsLock sync.Mutex
+
+// RegisterDetector replaces the detector with the same name
+func RegisterDetector(d Detector) {
+    detectorsLock.Lock()
+    defer detectorsLock.Unlock()
+    for i, prev := range(detectors) {
+	if prev.Name() == d.Name() {
+	    detectors[i] = d
+	    return
+	}
+    }
+    detectors = append(detectors, d)
+}
+
+func Detectors() []Detector {
+    detectorsLock.Lock()
+    defer detectorsLock.Unlock()
+    return append([]Detector{}, detectors...)
+}
+
+func FindDetector(name string) Detector {
+    for _, d := range(Detectors()) {
+	if d.Name() == name {
+	    return d
+	}
+    }
+    return nil
+}
+
+// Detect runs the registered detectors in names
+func Detect(resp *Response, names []string) Verdict {
+    for _, name := range(names) {
+	d := FindDetector(name)
+	if d == nil {
+	    continue
+	}
+	v := d.Detect(resp)
+	if v.Blocked {
+	    return v
+	}
+    }
+    return Verdict{}
+}
+
+// simple detector, any of conditions hits
+type patternDetector struct {
+    name string
+    status int
+    headers map[string]string // header key and substring of the value
+    body []string
+}
+
+func (p *patternDetector)Name() string {
+    return p.name
+}
+
+func (p *patternDetector)Detect(resp *Response) Verdict {
+    if p.status != 0 && resp.Status == p.status {
+	return Verdict{ Blocked: true, Reason: p.name + ": status " + http.StatusText(p.status) }
+    }
+    for key, val := range(p.headers) {
+	for _, h := range(resp.Header[http.CanonicalHeaderKey(key)]) {
+	    if strings.Contains(strings.ToLower(h), val) {
+		return Verdict{ Blocked: true, Reason: p.name + ": header " + key }
+	    }
+	}
+    }
+    for _, b := range(p.body) {
+	if bytes.Contains(resp.Raw, []byte(b)) {
+	    return Verdict{ Blocked: true, Reason: p.name + ": " + b }
+	}
+    }
+    return Verdict{}
+}
+
+func init() {
+    RegisterDetector(&patternDetector{
+	name: "cloudflare",
+	headers: map[string]string{ "Cf-Mitigated": "challenge" },
+	body: []string{ `<title>Attention Required! | Cloudflare</title>`, `<title>Just a moment...</title>` },
+    })
+    RegisterDetector(&patternDetector{
+	name: "google",
+	body: []string{ `https://www.google.com/sorry/index?continue` },
+    })
+    RegisterDetector(&patternDetector{
+	name: "akamai",
+	body: []string{ `<TITLE>Access Denied</TITLE>` },
+    })
+    RegisterDetector(&patternDetector{
+	name: "perimeterx",
+	body: []string{ `px-captcha`, `captcha.px-cdn.net` },
+    })
+    RegisterDetector(&patternDetector{
+	name: "datadome",
+	headers: map[string]string{ "X-Datadome": "protected" },
+	body: []string{ `geo.captcha-delivery.com` },
+    })
+    RegisterDetector(&patternDetector{
+	name: "recaptcha",
+	body: []string{ `www.google.com/recaptcha/api.js`, `www.recaptcha.net/recaptcha/api.js` },
+    })
+    RegisterDetector(&patternDetector{
+	name: "ratelimit",
+	status: http.StatusTooManyRequests,
+    })
+}
@@ -0,0 +1,119 @@
+// go-multiproxier/connection / diagnose.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package connection
+
+import (
+    "bufio"
+    "crypto/tls"
+    "fmt"
+    "net"
+    "net/http"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/outproxy"
+)
+
+// called for each diagnose step
+type TraceFunc func(step string, d time.Duration, err error, detail string)
+
+func readConnectReply(conn net.Conn, to time.Duration) error {
+    buf := make([]byte, 256)
+    conn.SetReadDeadline(time.Now().Add(to))
+    n, err := conn.Read(buf)
+    if err != nil {
+	return err
+    }
+    if n == 0 {
+	return fmt.Errorf("remote connection closed")
+    }
+    return CheckConnectOK(string(buf[:n]))
+}
+
+// Diagnose runs the same steps as a certcheck through outer and reports
+// every step to trace. It never touches outproxy state or statistics.
+func Diagnose(proxy string, outer *outproxy.OutProxy, host string, probe *Probe, trace TraceFunc) error {
+    to := outer.GetTimeout()
+    if to == 0 {
+	to = timeout
+    }
+    if probe == nil {
+	probe = DefaultProbe(host)
+    }
+    step := func(name string, f func() (string, error)) error {
+	start := time.Now()
+	detail, err := f()
+	trace(name, time.Since(start), err, detail)
+	return err
+    }
+
+    var conn net.Conn
+    if proxy != "" {
+	err := step("dial", func() (string, error) {
+	    var err error
+	    conn, err = net.DialTimeout("tcp", proxy, timeout)
+	    return proxy, err
+	})
+	if err != nil {
+	    return err
+	}
+	defer conn.Close()
+	err = step("outproxy", func() (string, error) {
+	    conn.Write([]byte("CONNECT " + outer.Addr + " HTTP/1.0\r\n\r\n"))
+	    return outer.Addr, readConnectReply(conn, timeout)
+	})
+	if err != nil {
+	    return err
+	}
+    } else {
+	err := step("dial", func() (string, error) {
+	    var err error
+	    conn, err = net.DialTimeout("tcp", outer.Addr, to)
+	    return outer.Addr, err
+	})
+	if err != nil {
+	    return err
+	}
+	defer conn.Close()
+    }
+
+    err := step("connect", func() (string, error) {
+	conn.Write([]byte("CONNECT " + host + ":443 HTTP/1.0\r\n\r\n"))
+	return host + ":443", readConnectReply(conn, to)
+    })
+    if err != nil {
+	return err
+    }
+
+    client := tls.Client(conn, &tls.Config{ ServerName: host })
+    err = step("tls", func() (string, error) {
+	client.SetDeadline(time.Now().Add(to))
+	if err := client.Handshake(); err != nil {
+	    return "", err
+	}
+	st := client.ConnectionState()
+	certs := st.PeerCertificates
+	detail := fmt.Sprintf("%s %s", tls.VersionName(st.Version), tls.CipherSuiteName(st.CipherSuite))
+	if len(certs) > 0 {
+	    detail += " leaf " + Fingerprint(certs[0]) + " issuer " + certs[0].Issuer.String()
+	}
+	return detail, probe.CheckCerts(st.VerifiedChains)
+    })
+    if err != nil {
+	return err
+    }
+
+    return step("http", func() (string, error) {
+	client.SetDeadline(time.Now().Add(to))
+	client.Write([]byte(probe.Request(host)))
+	resp, err := http.ReadResponse(bufio.NewReader(client), &http.Request{ Method: probe.Method })
+	if err != nil {
+	    return probe.Method + " " + probe.Path, err
+	}
+	defer resp.Body.Close()
+	return probe.Method + " " + probe.Path + " " + resp.Status, probe.Check(NewResponse(resp))
+    })
+}
@@ -0,0 +1,304 @@
+// go-multiproxier/connection / probe.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package connection
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// health probe for certcheck
+type Probe struct {
+    Method string
+    Path string
+    Headers []string
+    Status []int
+    Block []string
+    BlockRe [](*regexp.Regexp)
+    Ok []string
+    OkRe [](*regexp.Regexp)
+    // detectors used for this probe
+    Detect []string
+    // certificate pinning
+    Pins []string // sha256/base64 of SPKI
+    Issuers []string
+}
+
+// PinError means the certificate is not what we expect
+type PinError struct {
+    Reason string
+}
+
+func (e *PinError)Error() string {
+    return "suspected MITM: " + e.Reason
+}
+
+// Fingerprint returns sha256 of the certificate in hex
+func Fingerprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return hex.EncodeToString(sum[:])
+}
+
+func SPKIHash(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IssuerKey identifies the root CA of the verified chains, leaves and
+// intermediates differ among CDN servers but a MITM proxy signs with its
+// own root
+func IssuerKey(chains []([](*x509.Certificate))) string {
+    for _, chain := range(chains) {
+	if len(chain) > 0 {
+	    return SPKIHash(chain[len(chain) - 1])
+	}
+    }
+    return ""
+}
+
+// CheckCerts checks the verified chains against pins and issuers, a pin
+// may be on any certificate up to the root
+func (p *Probe)CheckCerts(chains []([](*x509.Certificate))) error {
+    if len(chains) == 0 || len(chains[0]) == 0 {
+	return &PinError{ Reason: "no verified chain" }
+    }
+    leaf := chains[0][0]
+    if len(p.Pins) > 0 {
+	found := false
+	for _, chain := range(chains) {
+	    for _, cert := range(chain) {
+		h := SPKIHash(cert)
+		for _, pin := range(p.Pins) {
+		    if h == pin {
+			found = true
+		    }
+		}
+	    }
+	}
+	if !found {
+	    return &PinError{ Reason: "no pinned key in chain, leaf " + SPKIHash(leaf) }
+	}
+    }
+    if len(p.Issuers) > 0 {
+	issuer := leaf.Issuer.String()
+	for _, i := range(p.Issuers) {
+	    if strings.Contains(issuer, i) {
+		return nil
+	    }
+	}
+	return &PinError{ Reason: "unexpected issuer " + issuer }
+    }
+    return nil
+}
+
+var presets = map[string]Probe{
+    "default": Probe{
+	Method: "GET",
+	Path: "/",
+	Headers: []string{ "User-Agent: curl/7.58.0", "Accept: */*" },
+    },
+    "cloudflare": Probe{
+	Method: "GET",
+	Path: "/",
+	Headers: []string{ "User-Agent: curl/7.58.0", "Accept: */*" },
+	Detect: []string{ "cloudflare" },
+    },
+    "google": Probe{
+	Method: "GET",
+	Path: "/search?source=hp&q=proxy",
+	Headers: []string{ "User-Agent: Mozilla/5.0 Gecko/20100101 Firefox/61.0", "Accept: */*" },
+	Detect: []string{ "google" },
+    },
+}
+
+// preset used when a cluster has no probe
+var defaultPresets = map[string]string{
+    "www.google.com": "google",
+}
+
+func NewProbe(preset string) (*Probe, error) {
+    p, ok := presets[preset]
+    if !ok {
+	return nil, errors.New("unknown probe preset: " + preset)
+    }
+    // don't share slices with the preset
+    p.Headers = append([]string{}, p.Headers...)
+    p.Detect = append([]string{}, p.Detect...)
+    return &p, nil
+}
+
+func DefaultProbe(host string) *Probe {
+    preset, ok := defaultPresets[host]
+    if !ok {
+	preset = "cloudflare"
+    }
+    p, _ := NewProbe(preset)
+    return p
+}
+
+// config line "key=value"
+func (p *Probe)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad probe line: " + line)
+    }
+    key, val := l[0], l[1]
+    switch key {
+    case "preset":
+	np, err := NewProbe(val)
+	if err != nil {
+	    return err
+	}
+	*p = *np
+    case "method":
+	p.Method = val
+    case "path":
+	p.Path = val
+    case "header":
+	if strings.Index(val, ":") <= 0 {
+	    return errors.New("bad probe header: " + val)
+	}
+	p.Headers = append(p.Headers, val)
+    case "status":
+	for _, s := range(strings.Split(val, ",")) {
+	    code, err := strconv.Atoi(strings.TrimSpace(s))
+	    if err != nil {
+		return err
+	    }
+	    p.Status = append(p.Status, code)
+	}
+    case "block":
+	p.Block = append(p.Block, val)
+    case "blockre":
+	re, err := regexp.Compile(val)
+	if err != nil {
+	    return err
+	}
+	p.BlockRe = append(p.BlockRe, re)
+    case "ok":
+	p.Ok = append(p.Ok, val)
+    case "okre":
+	re, err := regexp.Compile(val)
+	if err != nil {
+	    return err
+	}
+	p.OkRe = append(p.OkRe, re)
+    case "detect":
+	if FindDetector(val) == nil {
+	    return errors.New("unknown detector: " + val)
+	}
+	p.Detect = append(p.Detect, val)
+    case "pin":
+	if !strings.HasPrefix(val, "sha256/") {
+	    return errors.New("bad pin: " + val)
+	}
+	p.Pins = append(p.Pins, val)
+    case "issuer":
+	p.Issuers = append(p.Issuers, val)
+    default:
+	return errors.New("unknown probe key: " + key)
+    }
+    return nil
+}
+
+// Lines returns config lines which rebuild the probe
+func (p *Probe)Lines() []string {
+    lines := []string{ "method=" + p.Method, "path=" + p.Path }
+    for _, h := range(p.Headers) {
+	lines = append(lines, "header=" + h)
+    }
+    if len(p.Status) > 0 {
+	codes := []string{}
+	for _, code := range(p.Status) {
+	    codes = append(codes, strconv.Itoa(code))
+	}
+	lines = append(lines, "status=" + strings.Join(codes, ","))
+    }
+    for _, b := range(p.Block) {
+	lines = append(lines, "block=" + b)
+    }
+    for _, re := range(p.BlockRe) {
+	lines = append(lines, "blockre=" + re.String())
+    }
+    for _, o := range(p.Ok) {
+	lines = append(lines, "ok=" + o)
+    }
+    for _, re := range(p.OkRe) {
+	lines = append(lines, "okre=" + re.String())
+    }
+    for _, name := range(p.Detect) {
+	lines = append(lines, "detect=" + name)
+    }
+    for _, pin := range(p.Pins) {
+	lines = append(lines, "pin=" + pin)
+    }
+    for _, i := range(p.Issuers) {
+	lines = append(lines, "issuer=" + i)
+    }
+    return lines
+}
+
+func (p *Probe)Request(host string) string {
+    req := p.Method + " " + p.Path + " HTTP/1.1\r\n"
+    req += "Host: " + host + "\r\n"
+    for _, h := range(p.Headers) {
+	req += h + "\r\n"
+    }
+    req += "\r\n"
+    return req
+}
+
+// Check runs detectors and the probe's own patterns
+func (p *Probe)Check(resp *Response) error {
+    v := Detect(resp, p.Detect)
+    if v.Blocked {
+	return &v
+    }
+    for _, b := range(p.Block) {
+	if bytes.Index(resp.Raw, []byte(b)) >= 0 {
+	    return &Verdict{ Blocked: true, Reason: fmt.Sprintf("probe: %q", b) }
+	}
+    }
+    for _, re := range(p.BlockRe) {
+	if re.Match(resp.Raw) {
+	    return &Verdict{ Blocked: true, Reason: "probe: /" + re.String() + "/" }
+	}
+    }
+    if len(p.Status) > 0 {
+	found := false
+	for _, code := range(p.Status) {
+	    if code == resp.Status {
+		found = true
+	    }
+	}
+	if !found {
+	    return fmt.Errorf("unexpected status %d", resp.Status)
+	}
+    }
+    if len(p.Ok) == 0 && len(p.OkRe) == 0 {
+	return nil
+    }
+    for _, o := range(p.Ok) {
+	if bytes.Index(resp.Raw, []byte(o)) >= 0 {
+	    return nil
+	}
+    }
+    for _, re := range(p.OkRe) {
+	if re.Match(resp.Raw) {
+	    return nil
+	}
+    }
+    return errors.New("no ok pattern")
+}
@@ -0,0 +1,93 @@
+// go-multiproxier/connection / probe_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package connection
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "testing"
+    "time"
+)
+
+func newCert(t *testing.T, name string, ca bool, parent *x509.Certificate, pkey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+	t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+	SerialNumber: big.NewInt(time.Now().UnixNano()),
+	Subject: pkix.Name{ CommonName: name },
+	NotBefore: time.Now().Add(-time.Hour),
+	NotAfter: time.Now().Add(time.Hour),
+	IsCA: ca,
+	BasicConstraintsValid: true,
+    }
+    if ca {
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+    } else {
+	tmpl.DNSNames = []string{ name }
+    }
+    if parent == nil {
+	parent, pkey = tmpl, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, pkey)
+    if err != nil {
+	t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+	t.Fatal(err)
+    }
+    return cert, key
+}
+
+// verifiedChains returns the verified chains of a leaf under root via a new intermediate
+func verifiedChains(t *testing.T, root *x509.Certificate, rkey *ecdsa.PrivateKey) []([](*x509.Certificate)) {
+    inter, ikey := newCert(t, "inter", true, root, rkey)
+    leaf, _ := newCert(t, "example.com", false, inter, ikey)
+    roots, inters := x509.NewCertPool(), x509.NewCertPool()
+    roots.AddCert(root)
+    inters.AddCert(inter)
+    chains, err := leaf.Verify(x509.VerifyOptions{ DNSName: "example.com", Roots: roots, Intermediates: inters })
+    if err != nil {
+	t.Fatal(err)
+    }
+    return chains
+}
+
+func TestCheckCertsRootPin(t *testing.T) {
+    root, rkey := newCert(t, "root", true, nil, nil)
+    c := verifiedChains(t, root, rkey)
+    p := &Probe{ Pins: []string{ SPKIHash(root) } }
+    if err := p.CheckCerts(c); err != nil {
+	t.Errorf("root pin: %v", err)
+    }
+    p = &Probe{ Pins: []string{ "sha256/none" } }
+    if err := p.CheckCerts(c); err == nil {
+	t.Errorf("unknown pin accepted")
+    }
+    if err := (&Probe{}).CheckCerts(nil); err == nil {
+	t.Errorf("no chain accepted")
+    }
+}
+
+func TestIssuerKeyRoot(t *testing.T) {
+    root, rkey := newCert(t, "root", true, nil, nil)
+    a := IssuerKey(verifiedChains(t, root, rkey))
+    b := IssuerKey(verifiedChains(t, root, rkey))
+    if a != SPKIHash(root) || a != b {
+	t.Errorf("issuer key %s %s, root %s", a, b, SPKIHash(root))
+    }
+    other, okey := newCert(t, "other", true, nil, nil)
+    if IssuerKey(verifiedChains(t, other, okey)) == a {
+	t.Errorf("other root has the same issuer key")
+    }
+}
@@ -0,0 +1,110 @@
+// go-multiproxier/dns
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package dns
+
+import (
+    "errors"
+    "net"
+    "strings"
+)
+
+const (
+    TypeA = 1
+    TypeAAAA = 28
+    ClassINET = 1
+)
+
+type Question struct {
+    Name string
+    Type, Class uint16
+    end int // end of question section in the message
+}
+
+var errFormat = errors.New("bad DNS message")
+
+func be16(b []byte) uint16 {
+    return uint16(b[0]) << 8 | uint16(b[1])
+}
+
+func put16(b []byte, v uint16) []byte {
+    return append(b, byte(v >> 8), byte(v))
+}
+
+// ParseQuestion returns the first question of a standard query
+func ParseQuestion(msg []byte) (*Question, error) {
+    if len(msg) < 12 {
+	return nil, errFormat
+    }
+    if msg[2] & 0x80 != 0 || msg[2] & 0x78 != 0 {
+	return nil, errors.New("not a standard query")
+    }
+    if be16(msg[4:]) < 1 {
+	return nil, errors.New("no question")
+    }
+    labels := []string{}
+    off := 12
+    for {
+	if off >= len(msg) {
+	    return nil, errFormat
+	}
+	n := int(msg[off])
+	off++
+	if n == 0 {
+	    break
+	}
+	if n & 0xc0 != 0 || off + n > len(msg) {
+	    return nil, errFormat // no compression in question
+	}
+	labels = append(labels, string(msg[off:off+n]))
+	off += n
+    }
+    if off + 4 > len(msg) {
+	return nil, errFormat
+    }
+    q := &Question{
+	Name: strings.ToLower(strings.Join(labels, ".")),
+	Type: be16(msg[off:]),
+	Class: be16(msg[off+2:]),
+	end: off + 4,
+    }
+    return q, nil
+}
+
+// Answer builds the authoritative response to query with addresses
+// of the question type in ips
+func Answer(query []byte, q *Question, ips []net.IP, ttl uint32) []byte {
+    answers := [][]byte{}
+    for _, ip := range(ips) {
+	rdata := ip.To4()
+	if q.Type == TypeAAAA {
+	    if rdata != nil {
+		continue
+	    }
+	    rdata = ip.To16()
+	} else if q.Type != TypeA || rdata == nil {
+	    continue
+	}
+	rr := []byte{ 0xc0, 12 } // name of the question
+	rr = put16(rr, q.Type)
+	rr = put16(rr, ClassINET)
+	rr = append(rr, byte(ttl >> 24), byte(ttl >> 16), byte(ttl >> 8), byte(ttl))
+	rr = put16(rr, uint16(len(rdata)))
+	answers = append(answers, append(rr, rdata...))
+    }
+    resp := []byte{ query[0], query[1] }
+    // QR, opcode, AA and RD from query, RA
+    resp = append(resp, 0x84 | query[2] & 0x79, 0x80)
+    resp = put16(resp, 1)
+    resp = put16(resp, uint16(len(answers)))
+    resp = put16(resp, 0)
+    resp = put16(resp, 0)
+    resp = append(resp, query[12:q.end]...)
+    for _, rr := range(answers) {
+	resp = append(resp, rr...)
+    }
+    return resp
+}
@@ -44,5 +44,6 @@ func main() {
 	// never close
 	log.Println("logger change")
     }
-    up.Serve()
+    err = up.Serve()
+    log.Fatal("Serve:", err)
 }
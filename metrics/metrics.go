@@ -0,0 +1,129 @@
+// go-multiproxier/metrics
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package metrics
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// default buckets in seconds
+var Buckets = []float64{ 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30 }
+
+type Histogram struct {
+    buckets []float64
+    counts []uint64
+    count uint64
+    sum float64
+    m sync.Mutex
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+    return &Histogram{ buckets: buckets, counts: make([]uint64, len(buckets)) }
+}
+
+func (h *Histogram)Observe(v float64) {
+    h.m.Lock()
+    for i, b := range(h.buckets) {
+	if v <= b {
+	    h.counts[i]++
+	}
+    }
+    h.count++
+    h.sum += v
+    h.m.Unlock()
+}
+
+// Label is a name value pair, Labels keeps them in order
+type Label struct {
+    Name, Value string
+}
+
+func L(pairs ...string) []Label {
+    labels := []Label{}
+    for i := 0; i + 1 < len(pairs); i += 2 {
+	labels = append(labels, Label{ pairs[i], pairs[i + 1] })
+    }
+    return labels
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func format(labels []Label) string {
+    if len(labels) == 0 {
+	return ""
+    }
+    s := []string{}
+    for _, l := range(labels) {
+	s = append(s, l.Name + `="` + escaper.Replace(l.Value) + `"`)
+    }
+    return "{" + strings.Join(s, ",") + "}"
+}
+
+func value(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writer writes the text exposition format, the samples of a family
+// must be written together
+type Writer struct {
+    w io.Writer
+    seen map[string]bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+    return &Writer{ w: w, seen: map[string]bool{} }
+}
+
+func (mw *Writer)header(name, typ, help string) {
+    if mw.seen[name] {
+	return
+    }
+    mw.seen[name] = true
+    fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *Writer)Counter(name, help string, v float64, labels []Label) {
+    mw.header(name, "counter", help)
+    fmt.Fprintf(mw.w, "%s%s %s\n", name, format(labels), value(v))
+}
+
+func (mw *Writer)Gauge(name, help string, v float64, labels []Label) {
+    mw.header(name, "gauge", help)
+    fmt.Fprintf(mw.w, "%s%s %s\n", name, format(labels), value(v))
+}
+
+// CounterMap writes one sample per key with the key in label key
+func (mw *Writer)CounterMap(name, help string, m map[string]uint64, labels []Label, key string) {
+    keys := []string{}
+    for k := range(m) {
+	keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range(keys) {
+	l := append(append([]Label{}, labels...), Label{ key, k })
+	mw.Counter(name, help, float64(m[k]), l)
+    }
+}
+
+func (mw *Writer)Histogram(name, help string, h *Histogram, labels []Label) {
+    mw.header(name, "histogram", help)
+    h.m.Lock()
+    defer h.m.Unlock()
+    for i, b := range(h.buckets) {
+	l := append(append([]Label{}, labels...), Label{ "le", value(b) })
+	fmt.Fprintf(mw.w, "%s_bucket%s %d\n", name, format(l), h.counts[i])
+    }
+    l := append(append([]Label{}, labels...), Label{ "le", "+Inf" })
+    fmt.Fprintf(mw.w, "%s_bucket%s %d\n", name, format(l), h.count)
+    fmt.Fprintf(mw.w, "%s_sum%s %s\n", name, format(labels), value(h.sum))
+    fmt.Fprintf(mw.w, "%s_count%s %d\n", name, format(labels), h.count)
+}
@@ -9,51 +9,161 @@ package outproxy
 import (
     "fmt"
     "net"
+    "sort"
+    "sync"
+    "sync/atomic"
     "time"
 
     "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/metrics"
 )
 
+// Bad and Timeout are for the initial values, use the methods later
 type OutProxy struct {
     Addr string
     Bad time.Time
     Timeout time.Duration
     NumRunning int32
+    Pools []string
+    disabled int32
     // stats
     Success, Fail uint32
+    failures map[string]uint32
+    connect *metrics.Histogram
+    m sync.Mutex
+}
+
+func (outproxy *OutProxy)InPool(pool string) bool {
+    for _, p := range(outproxy.Pools) {
+	if p == pool {
+	    return true
+	}
+    }
+    return false
+}
+
+// disabled outproxies are skipped by new attempts
+func (outproxy *OutProxy)SetDisabled(disabled bool) {
+    v := int32(0)
+    if disabled {
+	v = 1
+    }
+    atomic.StoreInt32(&outproxy.disabled, v)
+}
+
+func (outproxy *OutProxy)Disabled() bool {
+    return atomic.LoadInt32(&outproxy.disabled) != 0
+}
+
+// Usable reports whether a new attempt may use outproxy
+func (outproxy *OutProxy)Usable() bool {
+    return !outproxy.Disabled() && !outproxy.IsBad()
+}
+
+// SetBad keeps new attempts away for d, 0 makes it good
+func (outproxy *OutProxy)SetBad(d time.Duration) {
+    outproxy.m.Lock()
+    outproxy.Bad = time.Now().Add(d)
+    outproxy.m.Unlock()
+}
+
+func (outproxy *OutProxy)BadUntil() time.Time {
+    outproxy.m.Lock()
+    defer outproxy.m.Unlock()
+    return outproxy.Bad
+}
+
+func (outproxy *OutProxy)IsBad() bool {
+    return outproxy.BadUntil().After(time.Now())
+}
+
+func (outproxy *OutProxy)GetTimeout() time.Duration {
+    outproxy.m.Lock()
+    defer outproxy.m.Unlock()
+    return outproxy.Timeout
+}
+
+// CountFailure counts failures by reason
+func (outproxy *OutProxy)CountFailure(reason string) {
+    outproxy.m.Lock()
+    if outproxy.failures == nil {
+	outproxy.failures = map[string]uint32{}
+    }
+    outproxy.failures[reason]++
+    outproxy.m.Unlock()
+}
+
+// ObserveConnect records the time until the CONNECT answer
+func (outproxy *OutProxy)ObserveConnect(d time.Duration) {
+    outproxy.m.Lock()
+    if outproxy.connect == nil {
+	outproxy.connect = metrics.NewHistogram(metrics.Buckets)
+    }
+    h := outproxy.connect
+    outproxy.m.Unlock()
+    h.Observe(d.Seconds())
+}
+
+func (outproxy *OutProxy)ConnectLatency() *metrics.Histogram {
+    outproxy.m.Lock()
+    defer outproxy.m.Unlock()
+    if outproxy.connect == nil {
+	outproxy.connect = metrics.NewHistogram(metrics.Buckets)
+    }
+    return outproxy.connect
+}
+
+func (outproxy *OutProxy)Failures() []string {
+    outproxy.m.Lock()
+    defer outproxy.m.Unlock()
+    reasons := []string{}
+    for reason := range(outproxy.failures) {
+	reasons = append(reasons, reason)
+    }
+    sort.Strings(reasons)
+    lines := []string{}
+    for _, reason := range(reasons) {
+	lines = append(lines, fmt.Sprintf("%d %s", outproxy.failures[reason], reason))
+    }
+    return lines
 }
 
 func (outproxy *OutProxy)Line() string {
     st := "o"
-    if outproxy.Bad.After(time.Now()) {
+    if outproxy.Disabled() {
+	st = "-"
+    } else if outproxy.IsBad() {
 	st = "x"
     }
     name := outproxy.Addr
-    succ := outproxy.Success
-    fail := outproxy.Fail
-    run := outproxy.NumRunning
-    to := outproxy.Timeout
+    succ := atomic.LoadUint32(&outproxy.Success)
+    fail := atomic.LoadUint32(&outproxy.Fail)
+    run := atomic.LoadInt32(&outproxy.NumRunning)
+    to := outproxy.GetTimeout()
     return fmt.Sprintf("%s %s %d %d r:%d to:%v\n", st, name, succ, fail, run, to)
 }
 
 func (outproxy *OutProxy)CheckConnect(conn net.Conn, label string) ([]byte, error) {
     buf := make([]byte, 256)
-    conn.SetReadDeadline(time.Now().Add(outproxy.Timeout))
+    conn.SetReadDeadline(time.Now().Add(outproxy.GetTimeout()))
     n, err := conn.Read(buf)
     if err != nil {
 	e, ok := err.(net.Error)
 	if ok && e.Timeout() {
 	    max := 30 * time.Second
+	    outproxy.m.Lock()
 	    t := outproxy.Timeout + 5 * time.Second
 	    if t > max {
 		t = max
 	    }
-	    if outproxy.Timeout != t {
+	    changed := outproxy.Timeout != t
+	    outproxy.Timeout = t
+	    outproxy.m.Unlock()
+	    if changed {
 		log.Printf("OutProxy %s timeout change to %v\n", outproxy.Addr, t)
-		outproxy.Timeout = t
 	    }
 	}
-	return nil, fmt.Errorf("%s: waiting CONNECT resp from %s: %s", label, outproxy.Addr, err.Error())
+	return nil, fmt.Errorf("%s: waiting CONNECT resp from %s: %w", label, outproxy.Addr, err)
     }
     if n == 0 {
 	return nil, fmt.Errorf("%s: remote connection to %s closed", label, outproxy.Addr)
@@ -61,3 +171,13 @@ func (outproxy *OutProxy)CheckConnect(conn net.Conn, label string) ([]byte, erro
     conn.SetReadDeadline(time.Now().Add(24 * time.Hour)) // 1day
     return buf[:n], err
 }
+
+func (outproxy *OutProxy)FailureCounts() map[string]uint32 {
+    outproxy.m.Lock()
+    defer outproxy.m.Unlock()
+    counts := map[string]uint32{}
+    for reason, n := range(outproxy.failures) {
+	counts[reason] = n
+    }
+    return counts
+}
@@ -0,0 +1,59 @@
+// go-multiproxier/outproxy / outproxy_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package outproxy
+
+import (
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestBadRecover(t *testing.T) {
+    o := &OutProxy{ Addr: "127.0.0.1:1", Bad: time.Now(), Timeout: time.Second }
+    if !o.Usable() {
+	t.Fatalf("new outproxy is not usable")
+    }
+    o.SetBad(time.Minute)
+    if o.Usable() || !o.IsBad() {
+	t.Fatalf("bad outproxy is usable")
+    }
+    o.SetBad(0)
+    if !o.Usable() {
+	t.Fatalf("recovered outproxy is not usable")
+    }
+}
+
+func TestConcurrentState(t *testing.T) {
+    o := &OutProxy{ Addr: "127.0.0.1:1", Bad: time.Now(), Timeout: 10 * time.Millisecond }
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+	wg.Add(3)
+	go func() {
+	    defer wg.Done()
+	    o.SetBad(time.Minute)
+	    o.SetBad(0)
+	}()
+	go func() {
+	    defer wg.Done()
+	    o.Usable()
+	    o.Line()
+	}()
+	go func() {
+	    defer wg.Done()
+	    // nobody answers, the timeout grows
+	    a, b := net.Pipe()
+	    defer a.Close()
+	    defer b.Close()
+	    o.CheckConnect(a, "test")
+	}()
+    }
+    wg.Wait()
+    if o.GetTimeout() <= 10 * time.Millisecond {
+	t.Errorf("timeout %v is not extended", o.GetTimeout())
+    }
+}
@@ -0,0 +1,132 @@
+// go-multiproxier/sni
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package sni
+
+import (
+    "errors"
+    "io"
+)
+
+type ClientHello struct {
+    ServerName string
+    ALPN []string
+}
+
+var ErrNotTLS = errors.New("not TLS handshake")
+var errShort = errors.New("short ClientHello")
+
+// limit of bytes read for a ClientHello
+const maxHello = 65536
+
+// Read reads TLS records from r until the ClientHello is complete.
+// It returns the parsed hello and every byte read, which must be sent
+// to the server.
+func Read(r io.Reader) (*ClientHello, []byte, error) {
+    raw := []byte{}
+    msg := []byte{}
+    for {
+	hdr := make([]byte, 5)
+	if k, err := io.ReadFull(r, hdr); err != nil {
+	    return nil, append(raw, hdr[:k]...), err
+	}
+	raw = append(raw, hdr...)
+	if hdr[0] != 0x16 || hdr[1] != 3 {
+	    return nil, raw, ErrNotTLS
+	}
+	n := int(hdr[3]) << 8 | int(hdr[4])
+	if len(raw) + n > maxHello {
+	    return nil, raw, errors.New("ClientHello too big")
+	}
+	body := make([]byte, n)
+	if k, err := io.ReadFull(r, body); err != nil {
+	    return nil, append(raw, body[:k]...), err
+	}
+	raw = append(raw, body...)
+	msg = append(msg, body...)
+	if len(msg) < 4 {
+	    continue
+	}
+	if msg[0] != 1 {
+	    return nil, raw, ErrNotTLS
+	}
+	mlen := int(msg[1]) << 16 | int(msg[2]) << 8 | int(msg[3])
+	if len(msg) < 4 + mlen {
+	    continue
+	}
+	hello, err := parse(msg[4:4+mlen])
+	return hello, raw, err
+    }
+}
+
+// reader for the handshake body
+type parser struct {
+    b []byte
+    err error
+}
+
+func (p *parser)bytes(n int) []byte {
+    if p.err != nil || len(p.b) < n {
+	p.err = errShort
+	return nil
+    }
+    b := p.b[:n]
+    p.b = p.b[n:]
+    return b
+}
+
+func (p *parser)uint(n int) int {
+    v := 0
+    for _, b := range(p.bytes(n)) {
+	v = v << 8 | int(b)
+    }
+    return v
+}
+
+// vector with n bytes length
+func (p *parser)vector(n int) *parser {
+    return &parser{ b: p.bytes(p.uint(n)), err: p.err }
+}
+
+func parse(b []byte) (*ClientHello, error) {
+    hello := &ClientHello{}
+    p := &parser{ b: b }
+    p.bytes(2 + 32) // version, random
+    p.vector(1) // session id
+    p.vector(2) // cipher suites
+    p.vector(1) // compression methods
+    if p.err == nil && len(p.b) == 0 {
+	return hello, nil // no extensions
+    }
+    exts := p.vector(2)
+    for exts.err == nil && len(exts.b) > 0 {
+	typ := exts.uint(2)
+	ext := exts.vector(2)
+	switch typ {
+	case 0: // server_name
+	    names := ext.vector(2)
+	    for names.err == nil && len(names.b) > 0 {
+		ntype := names.uint(1)
+		name := names.vector(2)
+		if ntype == 0 && name.err == nil {
+		    hello.ServerName = string(name.b)
+		}
+	    }
+	case 16: // application_layer_protocol_negotiation
+	    protos := ext.vector(2)
+	    for protos.err == nil && len(protos.b) > 0 {
+		proto := protos.vector(1)
+		if proto.err == nil {
+		    hello.ALPN = append(hello.ALPN, string(proto.b))
+		}
+	    }
+	}
+    }
+    if p.err != nil {
+	return nil, p.err
+    }
+    return hello, exts.err
+}
@@ -0,0 +1,152 @@
+// go-multiproxier/socks
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package socks
+
+import (
+    "errors"
+    "io"
+    "net"
+    "strconv"
+)
+
+// reply codes in RFC 1928
+const (
+    Succeeded = 0
+    GeneralFailure = 1
+    NotAllowed = 2
+    NetworkUnreachable = 3
+    HostUnreachable = 4
+    ConnectionRefused = 5
+    TTLExpired = 6
+    CommandNotSupported = 7
+    AddressNotSupported = 8
+)
+
+var ErrAuth = errors.New("socks authentication failed")
+
+func readBytes(conn net.Conn, n int) ([]byte, error) {
+    buf := make([]byte, n)
+    _, err := io.ReadFull(conn, buf)
+    return buf, err
+}
+
+// authenticate with RFC 1929 username/password
+func authenticate(conn net.Conn, auth func(user, pass string) bool) (string, error) {
+    hdr, err := readBytes(conn, 2)
+    if err != nil {
+	return "", err
+    }
+    user, err := readBytes(conn, int(hdr[1]))
+    if err != nil {
+	return "", err
+    }
+    plen, err := readBytes(conn, 1)
+    if err != nil {
+	return "", err
+    }
+    pass, err := readBytes(conn, int(plen[0]))
+    if err != nil {
+	return "", err
+    }
+    if hdr[0] != 1 || !auth(string(user), string(pass)) {
+	conn.Write([]byte{ 1, 1 })
+	return "", ErrAuth
+    }
+    _, err = conn.Write([]byte{ 1, 0 })
+    return string(user), err
+}
+
+// Handshake negotiates the method and reads the CONNECT request.
+// Username/password is required if auth is not nil.
+func Handshake(conn net.Conn, auth func(user, pass string) bool) (user, host, port string, err error) {
+    hdr, err := readBytes(conn, 2)
+    if err != nil {
+	return
+    }
+    if hdr[0] != 5 {
+	err = errors.New("not socks5")
+	return
+    }
+    methods, err := readBytes(conn, int(hdr[1]))
+    if err != nil {
+	return
+    }
+    want := byte(0) // no authentication required
+    if auth != nil {
+	want = 2
+    }
+    found := false
+    for _, m := range(methods) {
+	if m == want {
+	    found = true
+	}
+    }
+    if !found {
+	conn.Write([]byte{ 5, 0xff })
+	err = errors.New("no acceptable socks method")
+	return
+    }
+    if _, err = conn.Write([]byte{ 5, want }); err != nil {
+	return
+    }
+    if auth != nil {
+	if user, err = authenticate(conn, auth); err != nil {
+	    return
+	}
+    }
+    req, err := readBytes(conn, 4)
+    if err != nil {
+	return
+    }
+    if req[0] != 5 {
+	err = errors.New("bad socks request")
+	return
+    }
+    switch req[3] {
+    case 1: // IPv4
+	var a []byte
+	if a, err = readBytes(conn, 4); err != nil {
+	    return
+	}
+	host = net.IP(a).String()
+    case 3: // domain name
+	var l, a []byte
+	if l, err = readBytes(conn, 1); err != nil {
+	    return
+	}
+	if a, err = readBytes(conn, int(l[0])); err != nil {
+	    return
+	}
+	host = string(a)
+    case 4: // IPv6
+	var a []byte
+	if a, err = readBytes(conn, 16); err != nil {
+	    return
+	}
+	host = net.IP(a).String()
+    default:
+	Reply(conn, AddressNotSupported)
+	err = errors.New("unknown socks address type")
+	return
+    }
+    p, err := readBytes(conn, 2)
+    if err != nil {
+	return
+    }
+    port = strconv.Itoa(int(p[0]) << 8 | int(p[1]))
+    if req[1] != 1 {
+	Reply(conn, CommandNotSupported)
+	err = errors.New("socks command not supported")
+    }
+    return
+}
+
+// Reply sends the reply with no bound address
+func Reply(conn net.Conn, code byte) error {
+    _, err := conn.Write([]byte{ 5, code, 0, 1, 0, 0, 0, 0, 0, 0 })
+    return err
+}
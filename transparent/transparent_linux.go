@@ -0,0 +1,61 @@
+// go-multiproxier/transparent
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package transparent
+
+import (
+    "net"
+    "os"
+    "syscall"
+    "unsafe"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// OriginalDst returns the destination before iptables REDIRECT
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+    rc, err := conn.SyscallConn()
+    if err != nil {
+	return nil, err
+    }
+    var addr *net.TCPAddr
+    var serr error
+    v4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+    err = rc.Control(func(fd uintptr) {
+	// sockaddr_in fits in ipv6_mreq and sockaddr_in6 in ip6_mtuinfo
+	if v4 {
+	    mreq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+	    if e != nil {
+		serr = e
+		return
+	    }
+	    sa := mreq.Multiaddr
+	    addr = &net.TCPAddr{
+		IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(sa[2]) << 8 | int(sa[3]),
+	    }
+	    return
+	}
+	info, e := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+	if e != nil {
+	    serr = e
+	    return
+	}
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	addr = &net.TCPAddr{
+	    IP: append(net.IP{}, info.Addr.Addr[:]...),
+	    Port: int(port[0]) << 8 | int(port[1]),
+	}
+    })
+    if err != nil {
+	return nil, err
+    }
+    if serr != nil {
+	return nil, os.NewSyscallError("getsockopt SO_ORIGINAL_DST", serr)
+    }
+    return addr, nil
+}
@@ -0,0 +1,18 @@
+// go-multiproxier/transparent
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+//go:build !linux
+
+package transparent
+
+import (
+    "errors"
+    "net"
+)
+
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+    return nil, errors.New("transparent proxy is not supported")
+}
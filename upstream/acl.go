@@ -0,0 +1,120 @@
+// go-multiproxier/upstream / acl.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+
+    "github.com/hshimamoto/go-multiproxier/acl"
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// source address filters
+type ACLOption struct {
+    Proxy *acl.ACL
+    API *acl.ACL
+}
+
+func NewACLOption() *ACLOption {
+    return &ACLOption{ Proxy: acl.New(), API: acl.New() }
+}
+
+// config line in [acl]
+func (o *ACLOption)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad acl line: " + line)
+    }
+    switch l[0] {
+    case "allow":
+	return o.Proxy.Allow(l[1])
+    case "deny":
+	return o.Proxy.Deny(l[1])
+    case "api-allow":
+	return o.API.Allow(l[1])
+    case "api-deny":
+	return o.API.Deny(l[1])
+    }
+    return errors.New("unknown acl key: " + l[0])
+}
+
+func (o *ACLOption)Lines() []string {
+    lines := []string{}
+    for _, c := range(o.Proxy.Allows) {
+	lines = append(lines, "allow=" + c)
+    }
+    for _, c := range(o.Proxy.Denies) {
+	lines = append(lines, "deny=" + c)
+    }
+    for _, c := range(o.API.Allows) {
+	lines = append(lines, "api-allow=" + c)
+    }
+    for _, c := range(o.API.Denies) {
+	lines = append(lines, "api-deny=" + c)
+    }
+    return lines
+}
+
+// aclListener drops denied connections in Accept
+type aclListener struct {
+    net.Listener
+    name string
+    acl *acl.ACL
+}
+
+func (l *aclListener)Accept() (net.Conn, error) {
+    for {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+	    return nil, err
+	}
+	if l.acl.CheckAddr(conn.RemoteAddr()) {
+	    return conn, nil
+	}
+	_, denied := l.acl.Stats()
+	log.Printf("%s: deny %s (%d denied)\n", l.name, conn.RemoteAddr(), denied)
+	conn.Close()
+    }
+}
+
+func filter(name string, l net.Listener, a *acl.ACL) net.Listener {
+    if a.Empty() {
+	return l
+    }
+    return &aclListener{ Listener: l, name: name, acl: a }
+}
+
+// checkAPIACL writes 403 unless the in-band API client is allowed
+func (up *Upstream)checkAPIACL(w http.ResponseWriter, r *http.Request) bool {
+    if up.ACL.API.Empty() {
+	return true
+    }
+    c := clientOfRequest("", r)
+    if c.ip == nil || up.ACL.API.Check(c.ip) {
+	return true
+    }
+    _, denied := up.ACL.API.Stats()
+    log.Printf("api: deny %s (%d denied)\n", r.RemoteAddr, denied)
+    http.Error(w, "forbidden", http.StatusForbidden)
+    return false
+}
+
+func (up *Upstream)dumpACL(w http.ResponseWriter, r *http.Request) {
+    out := ""
+    for _, l := range(up.ACL.Lines()) {
+	out += l + "\n"
+    }
+    acc, den := up.ACL.Proxy.Stats()
+    out += fmt.Sprintf("proxy accepted %d denied %d\n", acc, den)
+    acc, den = up.ACL.API.Stats()
+    out += fmt.Sprintf("api accepted %d denied %d\n", acc, den)
+    w.Write([]byte(out))
+}
@@ -0,0 +1,119 @@
+// go-multiproxier/upstream / admin.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "crypto/subtle"
+    "errors"
+    "net/http"
+    "strings"
+
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// management API listener
+type AdminOption struct {
+    Listen []string
+    Tokens []string
+    InBand bool
+    inbandSet bool
+}
+
+func NewAdminOption() *AdminOption {
+    return &AdminOption{ InBand: true }
+}
+
+// config line in [api]
+func (o *AdminOption)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad api line: " + line)
+    }
+    var err error
+    switch l[0] {
+    case "listen":
+	o.Listen = append(o.Listen, l[1])
+    case "token":
+	if l[1] == "" {
+	    return errors.New("empty api token")
+	}
+	o.Tokens = append(o.Tokens, l[1])
+    case "inband":
+	o.InBand, err = onoff(l[1])
+	o.inbandSet = true
+    default:
+	err = errors.New("unknown api key: " + l[0])
+    }
+    return err
+}
+
+// finish turns the in-band API off when there is an admin listener,
+// unless inband= is given
+func (o *AdminOption)finish() {
+    if !o.inbandSet && len(o.Listen) > 0 {
+	o.InBand = false
+    }
+}
+
+// checkToken takes "Authorization: Bearer <token>"
+func (o *AdminOption)checkToken(r *http.Request) bool {
+    if len(o.Tokens) == 0 {
+	return true
+    }
+    h := r.Header.Get("Authorization")
+    if !strings.HasPrefix(h, "Bearer ") {
+	return false
+    }
+    token := []byte(strings.TrimSpace(h[7:]))
+    for _, t := range(o.Tokens) {
+	if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+	    return true
+	}
+    }
+    return false
+}
+
+func (up *Upstream)apiToken(w http.ResponseWriter, r *http.Request) bool {
+    if up.Admin.checkToken(r) {
+	return true
+    }
+    log.Println("api: bad token from", r.RemoteAddr)
+    w.Header().Set("WWW-Authenticate", `Bearer realm="` + up.Auth.Realm + `"`)
+    http.Error(w, "bad token", http.StatusUnauthorized)
+    return false
+}
+
+// AdminHandler serves the API on the admin listener, the API ACL is
+// applied by the listener
+func (up *Upstream)AdminHandler(w http.ResponseWriter, r *http.Request) {
+    log.Println("api:", r.Method, r.URL)
+    if !up.apiToken(w, r) {
+	return
+    }
+    up.handleAPI(w, r)
+}
+
+// handleInBandAPI serves the API on the proxy port, tokens replace the
+// user authentication when they are set
+func (up *Upstream)handleInBandAPI(w http.ResponseWriter, r *http.Request) {
+    if !up.Admin.InBand {
+	http.NotFound(w, r)
+	return
+    }
+    if !up.checkAPIACL(w, r) {
+	return
+    }
+    if len(up.Admin.Tokens) > 0 {
+	r.Header.Del("Proxy-Authorization")
+	if !up.apiToken(w, r) {
+	    return
+	}
+    } else if _, ok := up.checkAuth(w, r); !ok {
+	return
+    }
+    up.handleAPI(w, r)
+}
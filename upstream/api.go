@@ -7,12 +7,15 @@
 package upstream
 
 import (
+    "encoding/json"
     "fmt"
     "net/http"
     "strings"
+    "sync/atomic"
     "time"
 
     "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/connection"
     "github.com/hshimamoto/go-multiproxier/log"
     "github.com/hshimamoto/go-multiproxier/outproxy"
 )
@@ -50,14 +53,14 @@ func (up *Upstream)dumpBlockHosts(w http.ResponseWriter, r *http.Request) {
     // ignore request
     out := ""
     for _, h := range(up.BlockHosts) {
-	out += fmt.Sprintf("%s %d\n", h.String(), h.Blocked)
+	out += fmt.Sprintf("%s %d\n", h.String(), atomic.LoadUint64(&h.Blocked))
     }
     w.Write([]byte(out))
 }
 
 func (up *Upstream)dumpClusters(w http.ResponseWriter, r *http.Request) {
     // ignore request
-    for _, c := range(up.Clusters) {
+    for _, c := range(up.clusters()) {
 	out := makeClusterBlob(c)
 	w.Write([]byte(out))
     }
@@ -65,30 +68,106 @@ func (up *Upstream)dumpClusters(w http.ResponseWriter, r *http.Request) {
 
 func (up *Upstream)dumpConfig(w http.ResponseWriter, r *http.Request) {
     // ignore request
-    config := "# generated in program"
-    config += "[server]\n"
-    config += up.Listen + "\n"
-    config += "[upstream]\n"
-    proxies := up.DefaultCluster.OutProxies
-    for e := proxies.Front(); e != nil; e = e.Next() {
-	outproxy := e.Value.(*outproxy.OutProxy)
-	config += outproxy.Addr + "\n"
+    w.Write([]byte(up.RunningConfig().Redacted().String()))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", " ")
+    enc.Encode(v)
+}
+
+// certcheck results by cluster and outproxy
+func (up *Upstream)dumpMatrix(w http.ResponseWriter, r *http.Request) {
+    matrix := map[string]map[string][]cluster.Result{}
+    for _, c := range(up.clusters()) {
+	matrix[c.CertHost] = c.History()
+    }
+    writeJSON(w, matrix)
+}
+
+func (up *Upstream)findOutProxy(addr string) *outproxy.OutProxy {
+    up.DefaultCluster.Lock()
+    defer up.DefaultCluster.Unlock()
+    for e := up.DefaultCluster.OutProxies.Front(); e != nil; e = e.Next() {
+	o := e.Value.(*outproxy.OutProxy)
+	if o.Addr == addr {
+	    return o
+	}
+    }
+    return nil
+}
+
+// diagnose?host=X&outproxy=Y or diagnose?cluster=Z
+func (up *Upstream)diagnose(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    host := q.Get("host")
+    var probe *connection.Probe
+    outers := [](*outproxy.OutProxy){}
+    if cname := q.Get("cluster"); cname != "" {
+	cl := up.findCluster(cname)
+	if cl == nil {
+	    http.NotFound(w, r)
+	    return
+	}
+	if host == "" {
+	    host = cl.CertHost
+	}
+	probe = cl.Probe
+	cl.Lock()
+	for e := cl.OutProxies.Front(); e != nil; e = e.Next() {
+	    outers = append(outers, e.Value.(*outproxy.OutProxy))
+	}
+	cl.Unlock()
+    } else {
+	for _, c := range(up.clusters()) {
+	    if c.Host.Match(host) {
+		probe = c.Probe
+		break
+	    }
+	}
     }
-    config += "[proxy]\n"
-    config += up.MiddleAddr + "\n"
-    config += "[direct]\n"
-    for _, h := range(up.DirectHosts) {
-	config += h.String() + "\n"
+    if host == "" {
+	http.Error(w, "need host", http.StatusBadRequest)
+	return
     }
-    config += "[cluster]\n"
-    for _, c := range(up.Clusters) {
-	config += c.CertHost + "=" + c.Host.String() + "\n"
+    if addr := q.Get("outproxy"); addr != "" {
+	o := up.findOutProxy(addr)
+	if o == nil {
+	    http.NotFound(w, r)
+	    return
+	}
+	outers = [](*outproxy.OutProxy){ o }
     }
-    config += "[block]\n"
-    for _, h := range(up.BlockHosts) {
-	config += h.String() + "\n"
+    if len(outers) == 0 {
+	http.Error(w, "need outproxy or cluster", http.StatusBadRequest)
+	return
+    }
+    w.Header().Set("Content-Type", "text/plain")
+    flusher, _ := w.(http.Flusher)
+    for _, o := range(outers) {
+	start := time.Now()
+	fmt.Fprintf(w, "diagnose %s with %s\n", host, o.Addr)
+	err := connection.Diagnose(up.MiddleAddr, o, host, probe, func(step string, d time.Duration, err error, detail string) {
+	    result := "ok"
+	    if err != nil {
+		result = "NG " + err.Error()
+	    }
+	    fmt.Fprintf(w, " %-8s %8.1fms %s %s\n", step, float64(d) / float64(time.Millisecond), detail, result)
+	    if flusher != nil {
+		flusher.Flush()
+	    }
+	})
+	result := "ok"
+	if err != nil {
+	    result = "NG"
+	}
+	fmt.Fprintf(w, "%s %s in %v\n", o.Addr, result, time.Since(start))
+	if flusher != nil {
+	    flusher.Flush()
+	}
     }
-    w.Write([]byte(config))
 }
 
 func (up *Upstream)apiCluster(api []string, w http.ResponseWriter, r *http.Request) {
@@ -97,23 +176,89 @@ func (up *Upstream)apiCluster(api []string, w http.ResponseWriter, r *http.Reque
     }
     cname := api[0]
     cmd := api[1]
-    // lookup cluster
-    cluster := func() *cluster.Cluster {
-	for _, c := range(up.Clusters) {
-	    if cname == c.CertHost {
-		return c
-	    }
+    if cmd == "create" {
+	// cluster/<name>/create/<pattern>
+	if !mustPost(w, r) {
+	    return
+	}
+	if len(api) < 3 {
+	    http.Error(w, "need host pattern", http.StatusBadRequest)
+	    return
+	}
+	cl, err := up.createCluster(cname, api[2], nil)
+	if err != nil {
+	    http.Error(w, err.Error(), http.StatusConflict)
+	    return
 	}
-	return nil
-    }()
+	w.Write([]byte("create cluster " + cl.CertHost + "=" + cl.Host.String() + "\n"))
+	return
+    }
+    cluster := up.findCluster(cname)
     if cluster == nil {
+	http.NotFound(w, r)
 	return
     }
     switch cmd {
+    case "delete", "pattern":
+	if !mustPost(w, r) {
+	    return
+	}
+    }
+    switch cmd {
+    case "delete":
+	if err := up.deleteCluster(cname); err != nil {
+	    http.Error(w, err.Error(), http.StatusNotFound)
+	    return
+	}
+	w.Write([]byte("delete cluster " + cname + "\n"))
+    case "pattern":
+	if len(api) < 3 {
+	    http.Error(w, "need host pattern", http.StatusBadRequest)
+	    return
+	}
+	if _, err := up.setPattern(cluster, api[2]); err != nil {
+	    http.Error(w, err.Error(), http.StatusBadRequest)
+	    return
+	}
+	w.Write([]byte("cluster " + cname + " pattern " + api[2] + "\n"))
     case "show":
 	w.Write([]byte(makeClusterBlob(cluster)))
     case "logs":
 	w.Write([]byte(strings.Join(cluster.Logs(), "\n") + "\n"))
+    case "probe":
+	// cluster/<name>/probe?set=key=value&set=...
+	if lines, ok := r.URL.Query()["set"]; ok {
+	    if !mustPost(w, r) {
+		return
+	    }
+	    ncl, err := up.setProbe(cluster, lines)
+	    if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	    }
+	    cluster = ncl
+	}
+	w.Write([]byte(strings.Join(cluster.Probe.Lines(), "\n") + "\n"))
+    case "certs":
+	w.Write([]byte(strings.Join(cluster.Certs(), "\n") + "\n"))
+    case "history":
+	writeJSON(w, cluster.History())
+    case "interval":
+	if len(api) < 3 {
+	    http.Error(w, "need interval", http.StatusBadRequest)
+	    return
+	}
+	d := time.Duration(0)
+	if api[2] != "default" {
+	    var err error
+	    d, err = parseInterval(api[2])
+	    if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	    }
+	}
+	up.Sched.SetClusterInterval(cluster.CertHost, d)
+	w.Write([]byte("Set certcheck interval " + api[2] + " for " + cluster.CertHost + "\n"))
     case "bad":
 	cluster.Lock()
 	e := cluster.OutProxies.Front()
@@ -145,13 +290,47 @@ func (up *Upstream)apiBlock(api []string, w http.ResponseWriter, r *http.Request
     w.Write([]byte("block " + name + " " + on + "\n"))
 }
 
+func (up *Upstream)apiDirect(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) < 1 {
+	return
+    }
+    if api[0] == "list" {
+	for _, h := range(up.directHosts()) {
+	    w.Write([]byte(h.String() + "\n"))
+	}
+	return
+    }
+    if len(api) < 2 {
+	return
+    }
+    host := api[0]
+    if api[1] != "add" && api[1] != "remove" {
+	http.NotFound(w, r)
+	return
+    }
+    if !mustPost(w, r) {
+	return
+    }
+    var err error
+    if api[1] == "add" {
+	err = up.addDirect(host)
+    } else {
+	err = up.removeDirect(host)
+    }
+    if err != nil {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+	return
+    }
+    w.Write([]byte(api[1] + " direct " + host + "\n"))
+}
+
 func (up *Upstream)apiTemp(api []string, w http.ResponseWriter, r *http.Request) {
     if len(api) < 1 {
 	return
     }
     cname := api[0]
     if cname == "list" {
-	for _, c := range(up.TempClusters) {
+	for _, c := range(up.Temps.List()) {
 	    out := makeClusterBlob(c)
 	    w.Write([]byte(out))
 	}
@@ -161,16 +340,9 @@ func (up *Upstream)apiTemp(api []string, w http.ResponseWriter, r *http.Request)
 	return
     }
     cmd := api[1]
-    // lookup cluster
-    cluster := func() *cluster.Cluster {
-	for _, c := range(up.TempClusters) {
-	    if "Temporary for " + cname == c.CertHost {
-		return c
-	    }
-	}
-	return nil
-    }()
+    cluster := up.Temps.Find(cname)
     if cluster == nil {
+	http.NotFound(w, r)
 	return
     }
     switch cmd {
@@ -183,37 +355,90 @@ func (up *Upstream)apiTemp(api []string, w http.ResponseWriter, r *http.Request)
 	outproxy := e.Value.(*outproxy.OutProxy)
 	cluster.Unlock()
 	w.Write([]byte("bad outproxy " + outproxy.Addr + "\n"))
+    case "promote":
+	if !mustPost(w, r) {
+	    return
+	}
+	certhost := ""
+	if len(api) >= 3 {
+	    certhost = api[2]
+	}
+	cl, err := up.promote(cname, certhost, r.URL.Query().Get("pattern"))
+	if err != nil {
+	    http.Error(w, err.Error(), http.StatusBadRequest)
+	    return
+	}
+	up.Sched.Kick(cl)
+	w.Write([]byte("promote " + cname + " to " + cl.CertHost + "=" + cl.Host.String() + "\n"))
     }
 }
 
+// mustPost answers 405 unless r is POST, for commands changing state
+func mustPost(w http.ResponseWriter, r *http.Request) bool {
+    if r.Method == http.MethodPost {
+	return true
+    }
+    w.Header().Set("Allow", http.MethodPost)
+    http.Error(w, r.Method + " not allowed", http.StatusMethodNotAllowed)
+    return false
+}
+
 func (up *Upstream)apiOutProxy(api []string, w http.ResponseWriter, r *http.Request) {
     if len(api) < 2 {
 	return
     }
     name := api[0]
     cmd := api[1]
-    // lookup outproxy
-    up.DefaultCluster.Lock()
-    outproxy := func() *outproxy.OutProxy {
-	for e := up.DefaultCluster.OutProxies.Front(); e != nil; e = e.Next() {
-	    o := e.Value.(*outproxy.OutProxy)
-	    if o.Addr == name {
-		return o
-	    }
+    if cmd == "add" {
+	// outproxy/<addr>/add[?pools=a,b]
+	if !mustPost(w, r) {
+	    return
+	}
+	pools := []string{}
+	if p := r.URL.Query().Get("pools"); p != "" {
+	    pools = strings.Split(p, ",")
+	}
+	if _, err := up.addOutProxy(name, pools); err != nil {
+	    http.Error(w, err.Error(), http.StatusConflict)
+	    return
 	}
-	return nil
-    }()
-    up.DefaultCluster.Unlock()
+	w.Write([]byte("add outproxy " + name + "\n"))
+	return
+    }
+    outproxy := up.findOutProxy(name)
     if outproxy == nil {
+	http.NotFound(w, r)
 	return
     }
     switch cmd {
+    case "remove", "enable", "disable":
+	if !mustPost(w, r) {
+	    return
+	}
+    }
+    switch cmd {
+    case "remove":
+	if err := up.removeOutProxy(name); err != nil {
+	    http.Error(w, err.Error(), http.StatusNotFound)
+	    return
+	}
+	w.Write([]byte("remove outproxy " + name + "\n"))
+    case "enable":
+	outproxy.SetDisabled(false)
+	w.Write([]byte("enable outproxy " + outproxy.Addr + "\n"))
+    case "disable":
+	outproxy.SetDisabled(true)
+	w.Write([]byte("disable outproxy " + outproxy.Addr + "\n"))
     case "bad":
-	outproxy.Bad = time.Now().Add(10 * time.Minute)
+	outproxy.SetBad(10 * time.Minute)
 	w.Write([]byte("bad outproxy " + outproxy.Addr + "\n"))
     case "good":
-	outproxy.Bad = time.Now()
+	outproxy.SetBad(0)
 	w.Write([]byte("good outproxy " + outproxy.Addr + "\n"))
+    case "failures":
+	for _, line := range(outproxy.Failures()) {
+	    w.Write([]byte(line + "\n"))
+	}
     }
 }
 
@@ -222,10 +447,25 @@ func (up *Upstream)handleAPI(w http.ResponseWriter, r *http.Request) {
     dirs := strings.Split(r.URL.Path, "/")[1:] // remove first /
     log.Println(dirs)
     switch dirs[0] {
-    case "config": up.dumpConfig(w, r)
+    case "config":
+	if len(dirs) > 1 && dirs[1] == "save" {
+	    if !mustPost(w, r) {
+		return
+	    }
+	    if err := up.SaveConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	    }
+	    w.Write([]byte("save config " + up.path + "\n"))
+	    return
+	}
+	up.dumpConfig(w, r)
     case "clusters": up.dumpClusters(w, r)
     case "outproxies": up.dumpOutProxies(w, r)
     case "blockhosts": up.dumpBlockHosts(w, r)
+    case "acl": up.dumpACL(w, r)
+    case "metrics": up.dumpMetrics(w, r)
+    case "usage": up.apiUsage(dirs[1:], w, r)
     case "certcheck":
 	if len(dirs) > 1 {
 	    switch dirs[1] {
@@ -233,19 +473,45 @@ func (up *Upstream)handleAPI(w http.ResponseWriter, r *http.Request) {
 		go up.DoCertCheck()
 		w.Write([]byte("Issue certcheck\n"))
 	    case "fast":
-		up.CertCheckInterval = 10 * time.Minute
+		up.Sched.SetInterval(10 * time.Minute)
 		w.Write([]byte("Set certcheck fast\n"))
 	    case "slow":
-		up.CertCheckInterval = time.Hour
+		up.Sched.SetInterval(time.Hour)
 		w.Write([]byte("Set certcheck slow\n"))
+	    case "show":
+		w.Write([]byte(strings.Join(up.Sched.Lines(), "\n") + "\n"))
+	    case "matrix":
+		up.dumpMatrix(w, r)
+	    case "interval", "jitter", "probes":
+		if len(dirs) < 3 {
+		    http.Error(w, "need value", http.StatusBadRequest)
+		    return
+		}
+		if err := up.Sched.Set(dirs[1] + "=" + dirs[2]); err != nil {
+		    http.Error(w, err.Error(), http.StatusBadRequest)
+		    return
+		}
+		w.Write([]byte("Set certcheck " + dirs[1] + " " + dirs[2] + "\n"))
 	    }
 	} else {
 	    go up.DoCertCheck()
 	    w.Write([]byte("Issue certcheck\n"))
 	}
+    case "diagnose": up.diagnose(w, r)
+    case "explain": up.explain(w, r)
+    case "auth": up.apiAuth(dirs[1:], w, r)
     case "cluster": up.apiCluster(dirs[1:], w, r)
     case "block": up.apiBlock(dirs[1:], w, r)
+    case "direct": up.apiDirect(dirs[1:], w, r)
     case "temp": up.apiTemp(dirs[1:], w, r)
     case "outproxy": up.apiOutProxy(dirs[1:], w, r)
+    case "api":
+	if len(dirs) > 1 && dirs[1] == "v1" {
+	    up.apiV1(dirs[2:], w, r)
+	    return
+	}
+	http.NotFound(w, r)
+    default:
+	http.NotFound(w, r)
     }
 }
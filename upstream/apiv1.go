@@ -0,0 +1,550 @@
+// go-multiproxier/upstream / apiv1.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/connection"
+    "github.com/hshimamoto/go-multiproxier/outproxy"
+)
+
+// JSON views for /api/v1
+
+type OutProxyView struct {
+    Addr string `json:"addr"`
+    Disabled bool `json:"disabled"`
+    Bad bool `json:"bad"`
+    BadUntil *time.Time `json:"bad_until,omitempty"`
+    Success uint32 `json:"success"`
+    Fail uint32 `json:"fail"`
+    Running int32 `json:"running"`
+    Timeout string `json:"timeout"`
+    Pools []string `json:"pools,omitempty"`
+    Failures map[string]uint32 `json:"failures,omitempty"`
+}
+
+func outProxyView(o *outproxy.OutProxy) *OutProxyView {
+    v := &OutProxyView{
+	Addr: o.Addr,
+	Success: atomic.LoadUint32(&o.Success),
+	Fail: atomic.LoadUint32(&o.Fail),
+	Running: atomic.LoadInt32(&o.NumRunning),
+	Timeout: o.GetTimeout().String(),
+	Pools: o.Pools,
+	Failures: o.FailureCounts(),
+	Disabled: o.Disabled(),
+    }
+    if bad := o.BadUntil(); bad.After(time.Now()) {
+	v.Bad = true
+	v.BadUntil = &bad
+    }
+    return v
+}
+
+type ClusterView struct {
+    Name string `json:"name"`
+    Host string `json:"host"`
+    Temporary bool `json:"temporary"`
+    CertOK *time.Time `json:"cert_ok"`
+    Expire *time.Time `json:"expire,omitempty"`
+    OutProxies []string `json:"outproxies"`
+    Probe []string `json:"probe,omitempty"`
+}
+
+func clusterView(c *cluster.Cluster, temp bool) *ClusterView {
+    c.Lock()
+    defer c.Unlock()
+    v := &ClusterView{
+	Name: c.CertHost,
+	Host: c.Host.String(),
+	Temporary: temp,
+	CertOK: c.CertOK,
+	OutProxies: []string{},
+    }
+    if temp {
+	expire := c.Expire
+	v.Expire = &expire
+    }
+    for e := c.OutProxies.Front(); e != nil; e = e.Next() {
+	v.OutProxies = append(v.OutProxies, e.Value.(*outproxy.OutProxy).Addr)
+    }
+    if c.Probe != nil {
+	v.Probe = c.Probe.Lines()
+    }
+    return v
+}
+
+// POST and PATCH body for clusters, probe lines replace the probe
+type ClusterRequest struct {
+    Name string `json:"name"`
+    Host string `json:"host"`
+    Probe []string `json:"probe"`
+}
+
+type HostView struct {
+    Host string `json:"host"`
+    Blocked *uint64 `json:"blocked,omitempty"`
+}
+
+type ConfigView struct {
+    Listen []string `json:"listen"`
+    Proxy string `json:"proxy"`
+    Upstream []string `json:"upstream"`
+    Direct []string `json:"direct"`
+    Clusters map[string]string `json:"clusters"`
+    Block []string `json:"block"`
+}
+
+type apiError struct {
+    Error string `json:"error"`
+}
+
+func jsonError(w http.ResponseWriter, code int, msg string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(apiError{ Error: msg })
+}
+
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", " ")
+    enc.Encode(v)
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+    if r.Body == nil {
+	return nil
+    }
+    dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1 << 20))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil && err != io.EOF {
+	return err
+    }
+    return nil
+}
+
+// allow writes 405 unless the method is one of methods
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+    for _, m := range(methods) {
+	if r.Method == m {
+	    return true
+	}
+    }
+    w.Header().Set("Allow", strings.Join(methods, ", "))
+    jsonError(w, http.StatusMethodNotAllowed, r.Method + " not allowed")
+    return false
+}
+
+func (up *Upstream)outProxies() [](*outproxy.OutProxy) {
+    dc := up.DefaultCluster
+    dc.Lock()
+    defer dc.Unlock()
+    outers := [](*outproxy.OutProxy){}
+    for e := dc.OutProxies.Front(); e != nil; e = e.Next() {
+	outers = append(outers, e.Value.(*outproxy.OutProxy))
+    }
+    return outers
+}
+
+func (up *Upstream)configView() *ConfigView {
+    v := &ConfigView{
+	Listen: up.Listen,
+	Proxy: up.MiddleAddr,
+	Upstream: []string{},
+	Direct: []string{},
+	Clusters: map[string]string{},
+	Block: []string{},
+    }
+    for _, o := range(up.outProxies()) {
+	v.Upstream = append(v.Upstream, o.Addr)
+    }
+    for _, h := range(up.directHosts()) {
+	v.Direct = append(v.Direct, h.String())
+    }
+    for _, c := range(up.clusters()) {
+	v.Clusters[c.CertHost] = c.Host.String()
+    }
+    for _, h := range(up.BlockHosts) {
+	v.Block = append(v.Block, h.String())
+    }
+    return v
+}
+
+// /api/v1/clusters[/<name>[/history|logs|certcheck|rotate]]
+func (up *Upstream)apiV1Clusters(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) == 0 {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+	    return
+	}
+	if r.Method == http.MethodPost {
+	    req := ClusterRequest{}
+	    if err := readJSON(r, &req); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	    }
+	    if req.Name == "" || req.Host == "" {
+		jsonError(w, http.StatusBadRequest, "need name and host")
+		return
+	    }
+	    cl, err := up.createCluster(req.Name, req.Host, req.Probe)
+	    if err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	    }
+	    writeJSONStatus(w, http.StatusCreated, clusterView(cl, false))
+	    return
+	}
+	views := []*ClusterView{}
+	for _, c := range(up.clusters()) {
+	    views = append(views, clusterView(c, false))
+	}
+	writeJSON(w, views)
+	return
+    }
+    cl := up.findCluster(api[0])
+    if cl == nil {
+	jsonError(w, http.StatusNotFound, "no cluster " + api[0])
+	return
+    }
+    if len(api) == 1 && r.Method == http.MethodDelete {
+	if err := up.deleteCluster(cl.CertHost); err != nil {
+	    jsonError(w, http.StatusNotFound, err.Error())
+	    return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+    }
+    if len(api) == 1 && r.Method == http.MethodPatch {
+	req := ClusterRequest{}
+	if err := readJSON(r, &req); err != nil {
+	    jsonError(w, http.StatusBadRequest, err.Error())
+	    return
+	}
+	if req.Name != "" && req.Name != cl.CertHost {
+	    jsonError(w, http.StatusBadRequest, "name can't be changed")
+	    return
+	}
+	// check the probe first and replace the cluster once, a bad request
+	// changes nothing
+	var p *connection.Probe
+	if req.Probe != nil {
+	    np, err := newProbe(cl.CertHost, req.Probe)
+	    if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	    }
+	    p = np
+	}
+	if req.Host != "" || p != nil {
+	    ncl, err := up.changeCluster(cl, req.Host, p, req.Probe)
+	    if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	    }
+	    cl = ncl
+	}
+	writeJSON(w, clusterView(cl, false))
+	return
+    }
+    if len(api) == 1 && !allow(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete) {
+	return
+    }
+    up.apiV1Cluster(cl, false, api[1:], w, r)
+}
+
+// apiV1Cluster is shared by clusters and temps
+func (up *Upstream)apiV1Cluster(cl *cluster.Cluster, temp bool, api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) == 0 {
+	if !allow(w, r, http.MethodGet) {
+	    return
+	}
+	writeJSON(w, clusterView(cl, temp))
+	return
+    }
+    switch api[0] {
+    case "history":
+	if allow(w, r, http.MethodGet) {
+	    writeJSON(w, cl.History())
+	}
+    case "logs":
+	if allow(w, r, http.MethodGet) {
+	    writeJSON(w, cl.Logs())
+	}
+    case "certs":
+	if allow(w, r, http.MethodGet) {
+	    writeJSON(w, cl.Certs())
+	}
+    case "certcheck":
+	if allow(w, r, http.MethodPost) {
+	    up.Sched.Kick(cl)
+	    w.WriteHeader(http.StatusAccepted)
+	}
+    case "rotate":
+	// same as /cluster/<name>/bad
+	if !allow(w, r, http.MethodPost) {
+	    return
+	}
+	cl.Lock()
+	if e := cl.OutProxies.Front(); e != nil {
+	    cl.OutProxies.MoveToBack(e)
+	}
+	cl.Unlock()
+	writeJSON(w, clusterView(cl, temp))
+    default:
+	jsonError(w, http.StatusNotFound, "unknown " + api[0])
+    }
+}
+
+// /api/v1/temps[/<host>[/promote]]
+func (up *Upstream)apiV1Temps(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) == 0 {
+	if !allow(w, r, http.MethodGet) {
+	    return
+	}
+	views := []*ClusterView{}
+	for _, c := range(up.Temps.List()) {
+	    views = append(views, clusterView(c, true))
+	}
+	writeJSON(w, views)
+	return
+    }
+    host := api[0]
+    tcl := up.Temps.Find(host)
+    if tcl == nil {
+	jsonError(w, http.StatusNotFound, "no temp cluster for " + host)
+	return
+    }
+    if len(api) == 1 {
+	if !allow(w, r, http.MethodGet, http.MethodDelete) {
+	    return
+	}
+	if r.Method == http.MethodGet {
+	    writeJSON(w, clusterView(tcl, true))
+	    return
+	}
+	if !up.Temps.Remove(tcl) {
+	    jsonError(w, http.StatusNotFound, "no temp cluster for " + host)
+	    return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+    }
+    if len(api) == 2 && api[1] == "promote" {
+	if !allow(w, r, http.MethodPost) {
+	    return
+	}
+	req := struct {
+	    Name string `json:"name"`
+	    Pattern string `json:"pattern"`
+	}{}
+	if err := readJSON(r, &req); err != nil {
+	    jsonError(w, http.StatusBadRequest, err.Error())
+	    return
+	}
+	cl, err := up.promote(host, req.Name, req.Pattern)
+	if err != nil {
+	    jsonError(w, http.StatusConflict, err.Error())
+	    return
+	}
+	up.Sched.Kick(cl)
+	writeJSONStatus(w, http.StatusCreated, clusterView(cl, false))
+	return
+    }
+    up.apiV1Cluster(tcl, true, api[1:], w, r)
+}
+
+// /api/v1/outproxies[/<addr>[/bad|good|enable|disable]]
+func (up *Upstream)apiV1OutProxies(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) == 0 {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+	    return
+	}
+	if r.Method == http.MethodPost {
+	    req := struct {
+		Addr string `json:"addr"`
+		Pools []string `json:"pools"`
+	    }{}
+	    if err := readJSON(r, &req); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	    }
+	    if req.Addr == "" {
+		jsonError(w, http.StatusBadRequest, "need addr")
+		return
+	    }
+	    o, err := up.addOutProxy(req.Addr, req.Pools)
+	    if err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	    }
+	    writeJSONStatus(w, http.StatusCreated, outProxyView(o))
+	    return
+	}
+	views := []*OutProxyView{}
+	for _, o := range(up.outProxies()) {
+	    views = append(views, outProxyView(o))
+	}
+	writeJSON(w, views)
+	return
+    }
+    o := up.findOutProxy(api[0])
+    if o == nil {
+	jsonError(w, http.StatusNotFound, "no outproxy " + api[0])
+	return
+    }
+    if len(api) == 1 {
+	if !allow(w, r, http.MethodGet, http.MethodDelete) {
+	    return
+	}
+	if r.Method == http.MethodDelete {
+	    if err := up.removeOutProxy(o.Addr); err != nil {
+		jsonError(w, http.StatusNotFound, err.Error())
+		return
+	    }
+	    w.WriteHeader(http.StatusNoContent)
+	    return
+	}
+	writeJSON(w, outProxyView(o))
+	return
+    }
+    switch api[1] {
+    case "enable", "disable":
+	if !allow(w, r, http.MethodPost) {
+	    return
+	}
+	o.SetDisabled(api[1] == "disable")
+    case "bad":
+	if !allow(w, r, http.MethodPost) {
+	    return
+	}
+	o.SetBad(10 * time.Minute)
+    case "good":
+	if !allow(w, r, http.MethodPost) {
+	    return
+	}
+	o.SetBad(0)
+    default:
+	jsonError(w, http.StatusNotFound, "unknown " + api[1])
+	return
+    }
+    writeJSON(w, outProxyView(o))
+}
+
+// /api/v1/direct[/<host>]
+func (up *Upstream)apiV1Direct(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) == 0 {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+	    return
+	}
+	if r.Method == http.MethodPost {
+	    req := HostView{}
+	    if err := readJSON(r, &req); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	    }
+	    if req.Host == "" {
+		jsonError(w, http.StatusBadRequest, "need host")
+		return
+	    }
+	    if err := up.addDirect(req.Host); err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	    }
+	    writeJSONStatus(w, http.StatusCreated, HostView{ Host: req.Host })
+	    return
+	}
+	views := []HostView{}
+	for _, h := range(up.directHosts()) {
+	    views = append(views, HostView{ Host: h.String() })
+	}
+	writeJSON(w, views)
+	return
+    }
+    if !allow(w, r, http.MethodDelete) {
+	return
+    }
+    if err := up.removeDirect(api[0]); err != nil {
+	jsonError(w, http.StatusNotFound, err.Error())
+	return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (up *Upstream)apiV1(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) > 0 && api[len(api) - 1] == "" {
+	api = api[:len(api) - 1]
+    }
+    if len(api) == 0 {
+	jsonError(w, http.StatusNotFound, "no resource")
+	return
+    }
+    switch api[0] {
+    case "clusters":
+	up.apiV1Clusters(api[1:], w, r)
+    case "temps":
+	up.apiV1Temps(api[1:], w, r)
+    case "outproxies":
+	up.apiV1OutProxies(api[1:], w, r)
+    case "block":
+	if !allow(w, r, http.MethodGet) {
+	    return
+	}
+	views := []HostView{}
+	for _, h := range(up.BlockHosts) {
+	    n := atomic.LoadUint64(&h.Blocked)
+	    views = append(views, HostView{ Host: h.String(), Blocked: &n })
+	}
+	writeJSON(w, views)
+    case "direct":
+	up.apiV1Direct(api[1:], w, r)
+    case "usage":
+	// usage[/<outproxy|cluster|host|client>]
+	if !allow(w, r, http.MethodGet) {
+	    return
+	}
+	if len(api) == 1 {
+	    all := map[string]map[string]Usage{}
+	    for _, kind := range(usageKinds) {
+		all[kind] = up.Usage.Get(kind)
+	    }
+	    writeJSON(w, all)
+	    return
+	}
+	usages := up.Usage.Get(api[1])
+	if usages == nil {
+	    jsonError(w, http.StatusNotFound, "unknown usage " + api[1])
+	    return
+	}
+	writeJSON(w, usages)
+    case "config":
+	if len(api) > 1 && api[1] == "save" {
+	    if !allow(w, r, http.MethodPost) {
+		return
+	    }
+	    if err := up.SaveConfig(); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	    }
+	    w.WriteHeader(http.StatusNoContent)
+	    return
+	}
+	if allow(w, r, http.MethodGet) {
+	    writeJSON(w, up.configView())
+	}
+    default:
+	jsonError(w, http.StatusNotFound, "unknown resource " + api[0])
+    }
+}
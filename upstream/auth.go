@@ -0,0 +1,132 @@
+// go-multiproxier/upstream / auth.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+
+    "github.com/hshimamoto/go-multiproxier/auth"
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// client authentication
+type AuthOption struct {
+    Users *auth.Users
+    Path string
+    Realm string
+}
+
+func NewAuthOption() *AuthOption {
+    return &AuthOption{ Realm: "multiproxier" }
+}
+
+// config line in [auth]
+func (o *AuthOption)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad auth line: " + line)
+    }
+    switch l[0] {
+    case "users":
+	users, err := auth.Load(l[1])
+	if err != nil {
+	    return err
+	}
+	o.Users = users
+	o.Path = l[1]
+    case "realm":
+	o.Realm = l[1]
+    default:
+	return errors.New("unknown auth key: " + l[0])
+    }
+    return nil
+}
+
+func (o *AuthOption)Enabled() bool {
+    return o.Users != nil
+}
+
+// checkAuth writes 407, or 401 for the API, unless the client is
+// authenticated
+func (up *Upstream)checkAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+    if !up.Auth.Enabled() {
+	return "", true
+    }
+    api := r.Method != http.MethodConnect && r.URL.Host == ""
+    // never pass credentials to the middle proxy
+    pa := r.Header.Get("Proxy-Authorization")
+    r.Header.Del("Proxy-Authorization")
+    req := &http.Request{ Header: http.Header{} }
+    req.Header.Set("Authorization", pa)
+    user, pass, ok := req.BasicAuth()
+    if !ok && api {
+	user, pass, ok = r.BasicAuth()
+    }
+    if ok && up.Auth.Users.Check(user, pass) {
+	return user, true
+    }
+    if ok {
+	log.Println("auth: reject", user, r.RemoteAddr)
+    }
+    challenge := `Basic realm="` + up.Auth.Realm + `"`
+    if api {
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+	return "", false
+    }
+    w.Header().Set("Proxy-Authenticate", challenge)
+    w.Header().Set("Connection", "close")
+    http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+    return "", false
+}
+
+func (up *Upstream)apiAuth(api []string, w http.ResponseWriter, r *http.Request) {
+    if !up.Auth.Enabled() {
+	http.NotFound(w, r)
+	return
+    }
+    if len(api) < 1 {
+	return
+    }
+    switch api[0] {
+    case "list":
+	w.Write([]byte(strings.Join(up.Auth.Users.Lines(), "\n") + "\n"))
+	return
+    case "reload":
+	if !mustPost(w, r) {
+	    return
+	}
+	if err := up.Auth.Users.Reload(); err != nil {
+	    http.Error(w, err.Error(), http.StatusInternalServerError)
+	    return
+	}
+	w.Write([]byte("reload " + up.Auth.Path + "\n"))
+	return
+    }
+    if len(api) < 2 {
+	return
+    }
+    name := api[0]
+    var err error
+    switch api[1] {
+    case "enable", "disable":
+	if !mustPost(w, r) {
+	    return
+	}
+	err = up.Auth.Users.SetEnabled(name, api[1] == "enable")
+    default:
+	http.NotFound(w, r)
+	return
+    }
+    if err != nil {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+	return
+    }
+    w.Write([]byte(api[1] + " user " + name + "\n"))
+}
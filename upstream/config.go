@@ -0,0 +1,340 @@
+// go-multiproxier/upstream / config.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// Section keeps every line including comments and blank lines,
+// Name is "" for the lines before the first section
+type Section struct {
+    Name string
+    Lines []string
+}
+
+// Config is the config file as written
+type Config struct {
+    Sections [](*Section)
+}
+
+func ParseConfig(text string) *Config {
+    text = strings.TrimSuffix(text, "\n")
+    c := &Config{}
+    sec := &Section{}
+    c.Sections = append(c.Sections, sec)
+    if text == "" {
+	return c
+    }
+    for _, line := range(strings.Split(text, "\n")) {
+	if line != "" && line[0] == '[' {
+	    sec = &Section{ Name: line }
+	    c.Sections = append(c.Sections, sec)
+	    continue
+	}
+	sec.Lines = append(sec.Lines, line)
+    }
+    return c
+}
+
+func (c *Config)String() string {
+    out := ""
+    for _, sec := range(c.Sections) {
+	if sec.Name != "" {
+	    out += sec.Name + "\n"
+	}
+	for _, line := range(sec.Lines) {
+	    out += line + "\n"
+	}
+    }
+    return out
+}
+
+const redacted = "REDACTED"
+
+// redactLine hides secrets in a data line of section name
+func redactLine(name, line string) string {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return line
+    }
+    switch {
+    case name == "[api]" && l[0] == "token":
+	return "token=" + redacted
+    case name == "[socks]" && l[0] == "user":
+	u := strings.SplitN(l[1], ":", 2)
+	return "user=" + u[0] + ":" + redacted
+    case name == "[auth]" && l[0] == "users":
+	return "users=" + redacted
+    }
+    return line
+}
+
+// Redacted is a copy for showing, secrets are replaced
+func (c *Config)Redacted() *Config {
+    nc := &Config{}
+    for _, sec := range(c.Sections) {
+	ns := &Section{ Name: sec.Name }
+	for _, line := range(sec.Lines) {
+	    if isData(line) {
+		line = redactLine(sec.Name, line)
+	    }
+	    ns.Lines = append(ns.Lines, line)
+	}
+	nc.Sections = append(nc.Sections, ns)
+    }
+    return nc
+}
+
+func isData(line string) bool {
+    return line != "" && line[0] != '#'
+}
+
+func sameLines(a, b []string) bool {
+    if len(a) != len(b) {
+	return false
+    }
+    a = append([]string{}, a...)
+    b = append([]string{}, b...)
+    sort.Strings(a)
+    sort.Strings(b)
+    for i := range(a) {
+	if a[i] != b[i] {
+	    return false
+	}
+    }
+    return true
+}
+
+// Merge returns a copy where the data lines of section name are lines.
+// Comments and the lines still in use stay in place, new lines go
+// after the last data line of the section.
+func (c *Config)Merge(name string, lines []string) *Config {
+    want := map[string]int{}
+    for _, l := range(lines) {
+	want[l]++
+    }
+    nc := &Config{}
+    var last *Section
+    lastPos := 0
+    for _, sec := range(c.Sections) {
+	ns := &Section{ Name: sec.Name, Lines: append([]string{}, sec.Lines...) }
+	nc.Sections = append(nc.Sections, ns)
+	if sec.Name != name {
+	    continue
+	}
+	kept := []string{}
+	pos := 0
+	for _, l := range(ns.Lines) {
+	    if !isData(l) {
+		kept = append(kept, l)
+		continue
+	    }
+	    if want[l] > 0 {
+		want[l]--
+		kept = append(kept, l)
+		pos = len(kept)
+	    }
+	}
+	ns.Lines = kept
+	last = ns
+	lastPos = pos
+    }
+    rest := []string{}
+    for _, l := range(lines) {
+	if want[l] > 0 {
+	    want[l]--
+	    rest = append(rest, l)
+	}
+    }
+    if len(rest) == 0 {
+	return nc
+    }
+    if last == nil {
+	last = &Section{ Name: name }
+	nc.Sections = append(nc.Sections, last)
+    }
+    tail := append(rest, last.Lines[lastPos:]...)
+    last.Lines = append(last.Lines[:lastPos], tail...)
+    return nc
+}
+
+// sections rebuilt from the running state, the others like [block] and
+// [policy] can't change at runtime and are saved as written
+var runtimeSections = []string{
+    "[upstream]", "[direct]", "[cluster]", "[probe]", "[certcheck]", "[temp]",
+}
+
+// sectionLines returns the data lines of a runtime section
+func (up *Upstream)sectionLines(name string) []string {
+    lines := []string{}
+    switch name {
+    case "[upstream]":
+	for _, o := range(up.outProxies()) {
+	    line := o.Addr
+	    if len(o.Pools) > 0 {
+		line += " " + strings.Join(o.Pools, ",")
+	    }
+	    if o.Disabled() {
+		line += " disabled"
+	    }
+	    lines = append(lines, line)
+	}
+    case "[direct]":
+	for _, h := range(up.directHosts()) {
+	    lines = append(lines, h.String())
+	}
+    case "[cluster]":
+	for _, c := range(up.clusters()) {
+	    lines = append(lines, c.CertHost + "=" + c.Host.String())
+	}
+    case "[probe]":
+	probes := up.probeLines()
+	for _, c := range(up.clusters()) {
+	    for _, l := range(probes[c.CertHost]) {
+		lines = append(lines, c.CertHost + ":" + l)
+	    }
+	}
+    case "[certcheck]":
+	lines = up.Sched.ConfigLines()
+    case "[temp]":
+	lines = up.Temps.ConfigLines()
+    }
+    return lines
+}
+
+func (up *Upstream)probeLines() map[string][]string {
+    up.m.Lock()
+    defer up.m.Unlock()
+    probes := map[string][]string{}
+    for k, v := range(up.probes) {
+	probes[k] = v
+    }
+    return probes
+}
+
+func (up *Upstream)setProbeLines(certhost string, lines []string) {
+    up.m.Lock()
+    if len(lines) == 0 {
+	delete(up.probes, certhost)
+    } else {
+	up.probes[certhost] = lines
+    }
+    up.m.Unlock()
+}
+
+// baseline records the runtime sections as loaded
+func (up *Upstream)baseline() {
+    up.loaded = map[string][]string{}
+    for _, name := range(runtimeSections) {
+	up.loaded[name] = up.sectionLines(name)
+    }
+}
+
+// RunningConfig is the config file with the runtime changes, sections
+// untouched since loading are kept as written
+func (up *Upstream)RunningConfig() *Config {
+    up.saveM.Lock()
+    defer up.saveM.Unlock()
+    return up.runningConfig()
+}
+
+func (up *Upstream)runningConfig() *Config {
+    c := up.config
+    for _, name := range(runtimeSections) {
+	lines := up.sectionLines(name)
+	if sameLines(lines, up.loaded[name]) {
+	    continue
+	}
+	c = c.Merge(name, lines)
+    }
+    return c
+}
+
+// writeFile replaces path with data through a synced temporary file
+func writeFile(path string, data []byte, mode os.FileMode) error {
+    tmp := path + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+    if err != nil {
+	return err
+    }
+    if _, err := f.Write(data); err != nil {
+	f.Close()
+	os.Remove(tmp)
+	return err
+    }
+    if err := f.Sync(); err != nil {
+	f.Close()
+	os.Remove(tmp)
+	return err
+    }
+    f.Close()
+    if err := os.Rename(tmp, path); err != nil {
+	os.Remove(tmp)
+	return err
+    }
+    return nil
+}
+
+// SaveConfig writes the running config to the config file atomically,
+// the previous file is kept as .bak
+func (up *Upstream)SaveConfig() error {
+    up.saveM.Lock()
+    defer up.saveM.Unlock()
+    c := up.runningConfig()
+    text := c.String()
+    mode := os.FileMode(0644)
+    old, err := ioutil.ReadFile(up.path)
+    if err == nil {
+	if fi, err := os.Stat(up.path); err == nil {
+	    mode = fi.Mode().Perm()
+	}
+	if err := writeFile(up.path + ".bak", old, mode); err != nil {
+	    return err
+	}
+    }
+    if err := writeFile(up.path, []byte(text), mode); err != nil {
+	return err
+    }
+    up.config = c
+    up.baseline()
+    log.Println("config saved:", up.path)
+    return nil
+}
+
+// config lines differing from the defaults
+func (s *Scheduler)ConfigLines() []string {
+    s.m.Lock()
+    defer s.m.Unlock()
+    lines := []string{}
+    if s.Interval != 10 * time.Minute {
+	lines = append(lines, "interval=" + s.Interval.String())
+    }
+    if s.Jitter != 0 {
+	lines = append(lines, "jitter=" + s.Jitter.String())
+    }
+    if n := cluster.MaxProbes(); n != 4 {
+	lines = append(lines, fmt.Sprintf("probes=%d", n))
+    }
+    hosts := []string{}
+    for h := range(s.intervals) {
+	hosts = append(hosts, h)
+    }
+    sort.Strings(hosts)
+    for _, h := range(hosts) {
+	lines = append(lines, h + ":interval=" + s.intervals[h].String())
+    }
+    return lines
+}
@@ -0,0 +1,147 @@
+// go-multiproxier/upstream / config_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestConfigMerge(t *testing.T) {
+    tests := []struct {
+	name string
+	src string
+	section string
+	lines []string
+	want string
+    }{
+	{
+	    name: "unchanged keeps comments",
+	    src: "# head\n[upstream]\n# first\na\n# second\nb\n",
+	    section: "[upstream]",
+	    lines: []string{ "b", "a" },
+	    want: "# head\n[upstream]\n# first\na\n# second\nb\n",
+	},
+	{
+	    name: "removed line keeps comments",
+	    src: "# head\n[upstream]\n# first\na\n# second\nb\n",
+	    section: "[upstream]",
+	    lines: []string{ "b" },
+	    want: "# head\n[upstream]\n# first\n# second\nb\n",
+	},
+	{
+	    name: "new line after the last data line",
+	    src: "[upstream]\na\n# trailing\n\n[proxy]\nx\n",
+	    section: "[upstream]",
+	    lines: []string{ "a", "c" },
+	    want: "[upstream]\na\nc\n# trailing\n\n[proxy]\nx\n",
+	},
+	{
+	    name: "new line in a section without data",
+	    src: "[upstream]\n# none yet\n",
+	    section: "[upstream]",
+	    lines: []string{ "a" },
+	    want: "[upstream]\na\n# none yet\n",
+	},
+	{
+	    name: "duplicate sections keep their lines",
+	    src: "[upstream]\na\n[proxy]\nx\n[upstream]\nb\n# end\n",
+	    section: "[upstream]",
+	    lines: []string{ "b", "a", "c" },
+	    want: "[upstream]\na\n[proxy]\nx\n[upstream]\nb\nc\n# end\n",
+	},
+	{
+	    name: "duplicate sections drop lines",
+	    src: "[upstream]\na\n[proxy]\nx\n[upstream]\nb\n# end\n",
+	    section: "[upstream]",
+	    lines: []string{ "b" },
+	    want: "[upstream]\n[proxy]\nx\n[upstream]\nb\n# end\n",
+	},
+	{
+	    name: "repeated line",
+	    src: "[upstream]\na\na\n",
+	    section: "[upstream]",
+	    lines: []string{ "a" },
+	    want: "[upstream]\na\n",
+	},
+	{
+	    name: "missing section",
+	    src: "# head\n[server]\ns\n",
+	    section: "[direct]",
+	    lines: []string{ "d" },
+	    want: "# head\n[server]\ns\n[direct]\nd\n",
+	},
+    }
+    for _, tt := range(tests) {
+	c := ParseConfig(tt.src)
+	if got := c.Merge(tt.section, tt.lines).String(); got != tt.want {
+	    t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+	}
+	if got := c.String(); got != tt.src {
+	    t.Errorf("%s: source changed to %q", tt.name, got)
+	}
+    }
+}
+
+func TestRunningConfigReload(t *testing.T) {
+    src := "# my proxy\n[server]\n127.0.0.1:0\n\n# outs\n[upstream]\n1.2.3.4:80 res\n# backup\n5.6.7.8:80\n" +
+	"[proxy]\n127.0.0.1:1\n[direct]\nlocal.example.com\n[cluster]\n# google\nwww.google.com=*.google.com\na.com=a.com\n" +
+	"[probe]\na.com:path=/z\n[certcheck]\ninterval=600s\n"
+    path := filepath.Join(t.TempDir(), "proxy.conf")
+    if err := ioutil.WriteFile(path, []byte(src), 0600); err != nil {
+	t.Fatal(err)
+    }
+    up, err := NewUpstream(path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if got := up.RunningConfig().String(); got != src {
+	t.Fatalf("running config of an unchanged upstream %q", got)
+    }
+
+    if _, err := up.addOutProxy("9.9.9.9:80", nil); err != nil {
+	t.Fatal(err)
+    }
+    if err := up.removeOutProxy("5.6.7.8:80"); err != nil {
+	t.Fatal(err)
+    }
+    if _, err := up.createCluster("b.com", "*.b.com", []string{ "status=200" }); err != nil {
+	t.Fatal(err)
+    }
+    if err := up.addDirect("other.example.com"); err != nil {
+	t.Fatal(err)
+    }
+    up.lookupCluster("x.example.com")
+    if err := up.SaveConfig(); err != nil {
+	t.Fatal(err)
+    }
+    saved, err := ioutil.ReadFile(path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    for _, s := range([]string{ "# my proxy\n", "# outs\n", "# google\n", "1.2.3.4:80 res\n9.9.9.9:80\n# backup\n[proxy]" }) {
+	if !strings.Contains(string(saved), s) {
+	    t.Errorf("saved config lacks %q", s)
+	}
+    }
+
+    up2, err := NewUpstream(path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    for _, name := range(runtimeSections) {
+	a, b := up.sectionLines(name), up2.sectionLines(name)
+	if !sameLines(a, b) {
+	    t.Errorf("%s: saved %v, reloaded %v", name, a, b)
+	}
+    }
+    if got := up2.RunningConfig().String(); got != string(saved) {
+	t.Errorf("running config after reload %q, saved %q", got, saved)
+    }
+}
@@ -0,0 +1,134 @@
+// go-multiproxier/upstream / dns.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/dns"
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// DNS responder for SNI proxy mode
+type DNSOption struct {
+    Listen []string
+    Upstream string
+    Addrs []net.IP
+    TTL uint32
+}
+
+func NewDNSOption() *DNSOption {
+    return &DNSOption{ TTL: 60 }
+}
+
+// config line in [dns]
+func (o *DNSOption)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad dns line: " + line)
+    }
+    switch l[0] {
+    case "listen":
+	o.Listen = append(o.Listen, l[1])
+    case "upstream":
+	o.Upstream = l[1]
+    case "address":
+	ip := net.ParseIP(l[1])
+	if ip == nil {
+	    return errors.New("bad dns address: " + l[1])
+	}
+	o.Addrs = append(o.Addrs, ip)
+    case "ttl":
+	ttl, err := strconv.ParseUint(l[1], 10, 32)
+	if err != nil {
+	    return err
+	}
+	o.TTL = uint32(ttl)
+    default:
+	return errors.New("unknown dns key: " + l[0])
+    }
+    return nil
+}
+
+// check rejects a listener which can't answer for clusters
+func (o *DNSOption)check() error {
+    if len(o.Listen) > 0 && len(o.Addrs) == 0 {
+	return errors.New("[dns] listen needs address")
+    }
+    return nil
+}
+
+// clusterHost reports whether name is covered by a cluster
+func (up *Upstream)clusterHost(name string) bool {
+    for _, c := range(up.clusters()) {
+	if c.Host.Match(name) {
+	    return true
+	}
+    }
+    return false
+}
+
+func (up *Upstream)forwardDNS(query []byte) ([]byte, error) {
+    if up.DNS.Upstream == "" {
+	return nil, errors.New("no upstream resolver")
+    }
+    conn, err := net.DialTimeout("udp", up.DNS.Upstream, 5 * time.Second)
+    if err != nil {
+	return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    if _, err := conn.Write(query); err != nil {
+	return nil, err
+    }
+    buf := make([]byte, 65535)
+    n, err := conn.Read(buf)
+    if err != nil {
+	return nil, err
+    }
+    return buf[:n], nil
+}
+
+func (up *Upstream)handleDNS(pc net.PacketConn, addr net.Addr, query []byte) {
+    q, err := dns.ParseQuestion(query)
+    if err == nil && up.clusterHost(q.Name) {
+	pc.WriteTo(dns.Answer(query, q, up.DNS.Addrs, up.DNS.TTL), addr)
+	return
+    }
+    resp, err := up.forwardDNS(query)
+    if err != nil {
+	log.Println("dns forward:", err)
+	return
+    }
+    pc.WriteTo(resp, addr)
+}
+
+func (up *Upstream)serveDNS(pc net.PacketConn) {
+    for {
+	buf := make([]byte, 65535)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+	    log.Println("dns:", err)
+	    if errors.Is(err, net.ErrClosed) {
+		return
+	    }
+	    time.Sleep(time.Second)
+	    continue
+	}
+	// the same clients as the proxy, not an open resolver
+	if !up.ACL.Proxy.CheckAddr(addr) {
+	    _, denied := up.ACL.Proxy.Stats()
+	    log.Printf("dns: deny %s (%d denied)\n", addr, denied)
+	    continue
+	}
+	go up.handleDNS(pc, addr, buf[:n])
+    }
+}
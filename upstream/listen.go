@@ -0,0 +1,83 @@
+// go-multiproxier/upstream / listen.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strings"
+
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// listen opens a listener for "addr", "unix:/path" or "tls:addr cert key"
+func listen(spec string) (net.Listener, error) {
+    if strings.HasPrefix(spec, "unix:") {
+	path := spec[5:]
+	// remove the stale socket, nobody answers on it
+	if fi, err := os.Stat(path); err == nil && fi.Mode() & os.ModeSocket != 0 {
+	    if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("socket in use: " + path)
+	    }
+	    os.Remove(path)
+	}
+	return net.Listen("unix", path)
+    }
+    if strings.HasPrefix(spec, "tls:") {
+	f := strings.Fields(spec[4:])
+	if len(f) != 3 {
+	    return nil, errors.New("need tls:addr cert key")
+	}
+	cert, err := tls.LoadX509KeyPair(f[1], f[2])
+	if err != nil {
+	    return nil, err
+	}
+	l, err := net.Listen("tcp", f[0])
+	if err != nil {
+	    return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{ Certificates: []tls.Certificate{ cert } }), nil
+    }
+    return net.Listen("tcp", spec)
+}
+
+// binder opens every listener before serving, so that a bind failure
+// stops startup
+type binder struct {
+    closers []io.Closer
+}
+
+func (b *binder)listen(name, spec string) (net.Listener, error) {
+    l, err := listen(spec)
+    if err != nil {
+	return nil, fmt.Errorf("%s listen %s: %w", name, spec, err)
+    }
+    log.Println(name, "on", spec)
+    b.closers = append(b.closers, l)
+    return l, nil
+}
+
+func (b *binder)listenPacket(name, addr string) (net.PacketConn, error) {
+    pc, err := net.ListenPacket("udp", addr)
+    if err != nil {
+	return nil, fmt.Errorf("%s listen %s: %w", name, addr, err)
+    }
+    log.Println(name, "on", addr)
+    b.closers = append(b.closers, pc)
+    return pc, nil
+}
+
+func (b *binder)close() {
+    for _, c := range(b.closers) {
+	c.Close()
+    }
+}
@@ -0,0 +1,224 @@
+// go-multiproxier/upstream / manage.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "sync/atomic"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/connection"
+    "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/outproxy"
+    "github.com/hshimamoto/go-multiproxier/webhost"
+)
+
+// every cluster which holds outproxies
+func (up *Upstream)allClusters() [](*cluster.Cluster) {
+    all := [](*cluster.Cluster){ up.DefaultCluster }
+    all = append(all, up.clusters()...)
+    return append(all, up.Temps.List()...)
+}
+
+// addOutProxy puts a new outproxy at the back of every cluster
+func (up *Upstream)addOutProxy(addr string, pools []string) (*outproxy.OutProxy, error) {
+    if addr == "" {
+	return nil, errors.New("need outproxy address")
+    }
+    up.m.Lock()
+    defer up.m.Unlock()
+    if up.findOutProxy(addr) != nil {
+	return nil, errors.New("outproxy exists: " + addr)
+    }
+    outer := &outproxy.OutProxy{
+	Addr: addr,
+	Bad: time.Now(),
+	Timeout: 15 * time.Second,
+	Pools: pools,
+    }
+    // DefaultCluster first, new temp clusters copy it
+    up.DefaultCluster.Add(outer)
+    for _, c := range(up.Clusters) {
+	c.Add(outer)
+    }
+    for _, c := range(up.Temps.List()) {
+	c.Add(outer)
+    }
+    log.Println("add outproxy:", addr)
+    return outer, nil
+}
+
+// removeOutProxy stops new attempts through addr at once, running
+// tunnels are left to finish
+func (up *Upstream)removeOutProxy(addr string) error {
+    up.m.Lock()
+    defer up.m.Unlock()
+    outer := up.findOutProxy(addr)
+    if outer == nil {
+	return errors.New("no outproxy " + addr)
+    }
+    outer.SetDisabled(true)
+    up.DefaultCluster.Remove(outer)
+    for _, c := range(up.Clusters) {
+	c.Remove(outer)
+    }
+    for _, c := range(up.Temps.List()) {
+	c.Remove(outer)
+    }
+    log.Printf("remove outproxy: %s (%d running)\n", addr, atomic.LoadInt32(&outer.NumRunning))
+    return nil
+}
+
+func newProbe(certhost string, lines []string) (*connection.Probe, error) {
+    p := connection.DefaultProbe(certhost)
+    for _, line := range(lines) {
+	if err := p.Set(line); err != nil {
+	    return nil, err
+	}
+    }
+    return p, nil
+}
+
+// createCluster makes a cluster with all outproxies and checks it soon
+func (up *Upstream)createCluster(certhost, pattern string, probe []string) (*cluster.Cluster, error) {
+    if certhost == "" || pattern == "" {
+	return nil, errors.New("need name and host pattern")
+    }
+    p, err := newProbe(certhost, probe)
+    if err != nil {
+	return nil, err
+    }
+    cl := cluster.New()
+    cl.CertHost = certhost
+    cl.Host = *webhost.NewWebHost(pattern)
+    cl.Probe = p
+    // hold up.m so that addOutProxy can't miss the new cluster
+    up.m.Lock()
+    defer up.m.Unlock()
+    dc := up.DefaultCluster
+    dc.Lock()
+    for e := dc.OutProxies.Front(); e != nil; e = e.Next() {
+	cl.OutProxies.PushBack(e.Value)
+    }
+    dc.Unlock()
+    if err := up.insertCluster(cl); err != nil {
+	return nil, err
+    }
+    if len(probe) > 0 {
+	up.probes[certhost] = probe
+    }
+    up.Sched.Kick(cl)
+    log.Println("create cluster:", cl)
+    return cl, nil
+}
+
+func (up *Upstream)deleteCluster(name string) error {
+    up.m.Lock()
+    defer up.m.Unlock()
+    for _, c := range(up.Clusters) {
+	if c.CertHost == name {
+	    up.dropCluster(c)
+	    delete(up.probes, name)
+	    log.Println("delete cluster:", name)
+	    return nil
+	}
+    }
+    return errors.New("no cluster " + name)
+}
+
+// replaceCluster swaps cl for ncl, under up.m
+func (up *Upstream)replaceCluster(cl, ncl *cluster.Cluster) error {
+    if !up.dropCluster(cl) {
+	return errors.New("no cluster " + cl.CertHost)
+    }
+    up.insertCluster(ncl)
+    up.Sched.Kick(ncl)
+    return nil
+}
+
+// changeCluster returns the cluster which replaces cl in one go, an
+// empty pattern or a nil probe p keeps the current one
+func (up *Upstream)changeCluster(cl *cluster.Cluster, pattern string, p *connection.Probe, lines []string) (*cluster.Cluster, error) {
+    ncl := cl.Copy()
+    if pattern != "" {
+	ncl.Host = *webhost.NewWebHost(pattern)
+    }
+    if p != nil {
+	ncl.Probe = p
+	ncl.CertOK = nil
+    }
+    up.m.Lock()
+    err := up.replaceCluster(cl, ncl)
+    up.m.Unlock()
+    if err != nil {
+	return nil, err
+    }
+    if p != nil {
+	up.setProbeLines(cl.CertHost, lines)
+    }
+    if pattern != "" {
+	log.Println("cluster:", ncl, "pattern", pattern)
+    }
+    return ncl, nil
+}
+
+// setPattern returns the cluster which replaces cl, it moves when it
+// turns into or from a wildcard
+func (up *Upstream)setPattern(cl *cluster.Cluster, pattern string) (*cluster.Cluster, error) {
+    if pattern == "" {
+	return nil, errors.New("need host pattern")
+    }
+    return up.changeCluster(cl, pattern, nil, nil)
+}
+
+// setProbe returns the cluster which replaces cl, with the default probe
+// and lines
+func (up *Upstream)setProbe(cl *cluster.Cluster, lines []string) (*cluster.Cluster, error) {
+    p, err := newProbe(cl.CertHost, lines)
+    if err != nil {
+	return nil, err
+    }
+    return up.changeCluster(cl, "", p, lines)
+}
+
+// directHosts returns a snapshot of DirectHosts
+func (up *Upstream)directHosts() [](*webhost.WebHost) {
+    up.m.Lock()
+    defer up.m.Unlock()
+    return append([](*webhost.WebHost){}, up.DirectHosts...)
+}
+
+func (up *Upstream)addDirect(host string) error {
+    if host == "" {
+	return errors.New("need host")
+    }
+    up.m.Lock()
+    defer up.m.Unlock()
+    for _, h := range(up.DirectHosts) {
+	if h.String() == host {
+	    return errors.New("direct host exists: " + host)
+	}
+    }
+    up.DirectHosts = append(up.DirectHosts, webhost.NewWebHost(host))
+    log.Println("add direct:", host)
+    return nil
+}
+
+func (up *Upstream)removeDirect(host string) error {
+    up.m.Lock()
+    defer up.m.Unlock()
+    for i, h := range(up.DirectHosts) {
+	if h.String() == host {
+	    hosts := append([](*webhost.WebHost){}, up.DirectHosts[:i]...)
+	    up.DirectHosts = append(hosts, up.DirectHosts[i + 1:]...)
+	    log.Println("remove direct:", host)
+	    return nil
+	}
+    }
+    return errors.New("no direct host " + host)
+}
@@ -0,0 +1,151 @@
+// go-multiproxier/upstream / metrics.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "net/http"
+    "sync/atomic"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/metrics"
+)
+
+func (up *Upstream)countDirect(sent, received int64) {
+    atomic.AddUint64(&up.DirectStats.Requests, 1)
+    atomic.AddUint64(&up.DirectStats.Sent, uint64(sent))
+    atomic.AddUint64(&up.DirectStats.Received, uint64(received))
+}
+
+type namedStats struct {
+    name string
+    stats *cluster.Stats
+}
+
+// clusterStats returns stats by cluster label, temp clusters are
+// counted together as "temporary"
+func (up *Upstream)clusterStats() []namedStats {
+    all := []namedStats{}
+    for _, c := range(up.clusters()) {
+	c.Lock()
+	all = append(all, namedStats{ c.CertHost, c.Stats })
+	c.Unlock()
+    }
+    dc := up.DefaultCluster
+    dc.Lock()
+    all = append(all, namedStats{ dc.CertHost, dc.Stats })
+    dc.Unlock()
+    return append(all, namedStats{ "temporary", up.Temps.Stats })
+}
+
+func boolValue(b bool) float64 {
+    if b {
+	return 1
+    }
+    return 0
+}
+
+// /metrics in the Prometheus text format
+func (up *Upstream)dumpMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    mw := metrics.NewWriter(w)
+    L := metrics.L
+
+    outers := up.outProxies()
+    for _, o := range(outers) {
+	mw.Counter("multiproxier_outproxy_success_total", "Tunnels established through the outproxy.",
+	    float64(atomic.LoadUint32(&o.Success)), L("outproxy", o.Addr))
+    }
+    for _, o := range(outers) {
+	mw.Counter("multiproxier_outproxy_fail_total", "Failed attempts through the outproxy.",
+	    float64(atomic.LoadUint32(&o.Fail)), L("outproxy", o.Addr))
+    }
+    for _, o := range(outers) {
+	mw.Gauge("multiproxier_outproxy_running", "Open tunnels through the outproxy.",
+	    float64(atomic.LoadInt32(&o.NumRunning)), L("outproxy", o.Addr))
+    }
+    for _, o := range(outers) {
+	mw.Gauge("multiproxier_outproxy_up", "1 if the outproxy takes new attempts, 0 if it is bad or disabled.",
+	    boolValue(o.Usable()), L("outproxy", o.Addr))
+    }
+    for _, o := range(outers) {
+	mw.Gauge("multiproxier_outproxy_disabled", "1 if the outproxy is disabled.",
+	    boolValue(o.Disabled()), L("outproxy", o.Addr))
+    }
+    for _, o := range(outers) {
+	counts := map[string]uint64{}
+	for reason, n := range(o.FailureCounts()) {
+	    counts[reason] = uint64(n)
+	}
+	mw.CounterMap("multiproxier_outproxy_detections_total", "Block pages detected by reason.",
+	    counts, L("outproxy", o.Addr), "reason")
+    }
+    for _, o := range(outers) {
+	mw.Histogram("multiproxier_outproxy_connect_seconds", "Time until the CONNECT answer of the outproxy.",
+	    o.ConnectLatency(), L("outproxy", o.Addr))
+    }
+
+    all := up.clusterStats()
+    for _, c := range(all) {
+	mw.Counter("multiproxier_cluster_requests_total", "Client requests routed to the cluster.",
+	    float64(atomic.LoadUint64(&c.stats.Requests)), L("cluster", c.name))
+    }
+    for _, c := range(all) {
+	mw.Counter("multiproxier_cluster_attempts_total", "Outproxy attempts in the cluster.",
+	    float64(atomic.LoadUint64(&c.stats.Attempts)), L("cluster", c.name))
+    }
+    for _, c := range(all) {
+	mw.Counter("multiproxier_cluster_failovers_total", "Attempts on another outproxy after a failure.",
+	    float64(atomic.LoadUint64(&c.stats.Failovers)), L("cluster", c.name))
+    }
+    for _, c := range(all) {
+	mw.Counter("multiproxier_cluster_failures_total", "Requests no outproxy could serve.",
+	    float64(atomic.LoadUint64(&c.stats.Failures)), L("cluster", c.name))
+    }
+    for _, c := range(all) {
+	mw.Counter("multiproxier_cluster_bytes_total", "Tunnel bytes by direction.",
+	    float64(atomic.LoadUint64(&c.stats.Sent)), L("cluster", c.name, "direction", "sent"))
+	mw.Counter("multiproxier_cluster_bytes_total", "Tunnel bytes by direction.",
+	    float64(atomic.LoadUint64(&c.stats.Received)), L("cluster", c.name, "direction", "received"))
+    }
+    for _, c := range(all) {
+	mw.CounterMap("multiproxier_certcheck_total", "Certcheck results by class.",
+	    c.stats.Checks(), L("cluster", c.name), "result")
+    }
+
+    ds := up.DirectStats
+    mw.Counter("multiproxier_direct_requests_total", "Connections going direct.",
+	float64(atomic.LoadUint64(&ds.Requests)), nil)
+    mw.Counter("multiproxier_direct_bytes_total", "Direct bytes by direction.",
+	float64(atomic.LoadUint64(&ds.Sent)), L("direction", "sent"))
+    mw.Counter("multiproxier_direct_bytes_total", "Direct bytes by direction.",
+	float64(atomic.LoadUint64(&ds.Received)), L("direction", "received"))
+
+    mw.Gauge("multiproxier_temp_clusters", "Live temporary clusters.",
+	float64(up.Temps.Len()), nil)
+
+    for _, h := range(up.BlockHosts) {
+	mw.Counter("multiproxier_block_hits_total", "Requests blocked by pattern.",
+	    float64(atomic.LoadUint64(&h.Blocked)), L("pattern", h.String(), "policy", ""))
+    }
+    for _, p := range(up.Policies) {
+	for _, h := range(p.BlockHosts) {
+	    mw.Counter("multiproxier_block_hits_total", "Requests blocked by pattern.",
+		float64(atomic.LoadUint64(&h.Blocked)), L("pattern", h.String(), "policy", p.Name))
+	}
+    }
+
+    accepted, denied := up.ACL.Proxy.Stats()
+    mw.Counter("multiproxier_acl_total", "Connections checked by the source address lists.",
+	float64(accepted), L("acl", "proxy", "result", "accepted"))
+    mw.Counter("multiproxier_acl_total", "Connections checked by the source address lists.",
+	float64(denied), L("acl", "proxy", "result", "denied"))
+    accepted, denied = up.ACL.API.Stats()
+    mw.Counter("multiproxier_acl_total", "Connections checked by the source address lists.",
+	float64(accepted), L("acl", "api", "result", "accepted"))
+    mw.Counter("multiproxier_acl_total", "Connections checked by the source address lists.",
+	float64(denied), L("acl", "api", "result", "denied"))
+}
@@ -0,0 +1,215 @@
+// go-multiproxier/upstream / policy.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "net"
+    "net/http"
+    "strings"
+    "sync/atomic"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/webhost"
+)
+
+// who is connecting
+type client struct {
+    user string
+    ip net.IP
+}
+
+func clientOf(user string, addr net.Addr) client {
+    cl := client{ user: user }
+    if tcp, ok := addr.(*net.TCPAddr); ok {
+	cl.ip = tcp.IP
+    }
+    return cl
+}
+
+func clientOfRequest(user string, r *http.Request) client {
+    cl := client{ user: user }
+    if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+	cl.ip = net.ParseIP(host)
+    }
+    return cl
+}
+
+func (c client)String() string {
+    s := c.ip.String()
+    if c.user != "" {
+	s = c.user + "@" + s
+    }
+    return s
+}
+
+// routing policy for users and client networks
+type Policy struct {
+    Name string
+    Users []string
+    Nets [](*net.IPNet)
+    Pool string
+    DirectHosts [](*webhost.WebHost)
+    BlockHosts [](*webhost.BlockHost)
+}
+
+// config line "key=value"
+func (p *Policy)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad policy line: " + line)
+    }
+    switch l[0] {
+    case "user":
+	p.Users = append(p.Users, strings.Split(l[1], ",")...)
+    case "net":
+	_, n, err := net.ParseCIDR(l[1])
+	if err != nil {
+	    return err
+	}
+	p.Nets = append(p.Nets, n)
+    case "pool":
+	p.Pool = l[1]
+    case "direct":
+	p.DirectHosts = append(p.DirectHosts, webhost.NewWebHost(l[1]))
+    case "block":
+	p.BlockHosts = append(p.BlockHosts, webhost.NewBlockHost(l[1]))
+    default:
+	return errors.New("unknown policy key: " + l[0])
+    }
+    return nil
+}
+
+// Match needs every given condition
+func (p *Policy)Match(c client) bool {
+    if len(p.Users) > 0 {
+	found := false
+	for _, u := range(p.Users) {
+	    if u == c.user {
+		found = true
+	    }
+	}
+	if !found {
+	    return false
+	}
+    }
+    if len(p.Nets) > 0 {
+	found := false
+	for _, n := range(p.Nets) {
+	    if c.ip != nil && n.Contains(c.ip) {
+		found = true
+	    }
+	}
+	if !found {
+	    return false
+	}
+    }
+    return true
+}
+
+func (up *Upstream)policy(c client) *Policy {
+    for _, p := range(up.Policies) {
+	if p.Match(c) {
+	    return p
+	}
+    }
+    return nil
+}
+
+// routing decision
+type route struct {
+    policy *Policy
+    blocked bool
+    direct bool
+    cluster *cluster.Cluster
+    pool string
+}
+
+func (rt *route)String() string {
+    s := "policy:-"
+    if rt.policy != nil {
+	s = "policy:" + rt.policy.Name
+    }
+    switch {
+    case rt.blocked:
+	s += " block"
+    case rt.direct:
+	s += " direct"
+    case rt.cluster == nil:
+	s += " cluster:new temporary"
+    default:
+	s += " cluster:" + rt.cluster.String()
+    }
+    if rt.pool != "" {
+	s += " pool:" + rt.pool
+    }
+    return s
+}
+
+// decide routes host:port for c, live counts block hits and creates
+// a temp cluster, otherwise it is just an explanation
+func (up *Upstream)decide(host, port string, c client, live bool) *route {
+    rt := &route{ policy: up.policy(c) }
+    if b := up.blockHost(host); b != nil {
+	if live {
+	    atomic.AddUint64(&b.Blocked, 1)
+	}
+	rt.blocked = true
+	return rt
+    }
+    if rt.policy != nil {
+	for _, b := range(rt.policy.BlockHosts) {
+	    if b.Match(host) {
+		if live {
+		    atomic.AddUint64(&b.Blocked, 1)
+		}
+		rt.blocked = true
+		return rt
+	    }
+	}
+	for _, d := range(rt.policy.DirectHosts) {
+	    if d.Match(host) {
+		rt.direct = true
+	    }
+	}
+	rt.pool = rt.policy.Pool
+    }
+    if port != "443" || up.checkDirect(host) {
+	rt.direct = true
+    }
+    if rt.direct {
+	return rt
+    }
+    if live {
+	rt.cluster = up.lookupCluster(host)
+    } else {
+	rt.cluster = up.matchCluster(host)
+    }
+    return rt
+}
+
+// explain?host=X[&port=443][&user=U][&ip=IP]
+func (up *Upstream)explain(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    host := q.Get("host")
+    if host == "" {
+	http.Error(w, "need host", http.StatusBadRequest)
+	return
+    }
+    port := q.Get("port")
+    if port == "" {
+	port = "443"
+    }
+    c := client{ user: q.Get("user"), ip: net.ParseIP(q.Get("ip")) }
+    rt := up.decide(host, port, c, false)
+    w.Write([]byte(host + ":" + port + " for " + c.String() + " " + rt.String() + "\n"))
+}
+
+func logRoute(host string, c client, rt *route) {
+    log.Printf("route %s for %s %v\n", host, c, rt)
+}
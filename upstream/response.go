@@ -0,0 +1,89 @@
+// go-multiproxier/upstream / response.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "strings"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+)
+
+// responses for the client when a CONNECT is refused
+type Response struct {
+    Name string
+    BlockPage []byte
+    FailPage []byte
+}
+
+func NewResponse() *Response {
+    return &Response{ Name: "multiproxier" }
+}
+
+// config line in [response]
+func (resp *Response)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad response line: " + line)
+    }
+    var err error
+    switch l[0] {
+    case "name":
+	resp.Name = l[1]
+    case "blockpage":
+	resp.BlockPage, err = ioutil.ReadFile(l[1])
+    case "failpage":
+	resp.FailPage, err = ioutil.ReadFile(l[1])
+    default:
+	err = errors.New("unknown response key: " + l[0])
+    }
+    return err
+}
+
+// sf-string in RFC 8941
+func quoteDetails(s string) string {
+    s = strings.Replace(s, `\`, `\\`, -1)
+    s = strings.Replace(s, `"`, `\"`, -1)
+    return `"` + s + `"`
+}
+
+func (resp *Response)write(w http.ResponseWriter, code int, class, details string, page []byte) {
+    status := resp.Name + "; error=" + class
+    if details != "" {
+	status += "; details=" + quoteDetails(details)
+    }
+    w.Header().Set("Proxy-Status", status)
+    w.Header().Set("Connection", "close")
+    if page == nil {
+	page = []byte(http.StatusText(code) + ": " + details + "\n")
+    }
+    w.Header().Set("Content-Type", http.DetectContentType(page))
+    w.WriteHeader(code)
+    w.Write(page)
+}
+
+func (resp *Response)Blocked(w http.ResponseWriter, host string) {
+    resp.write(w, http.StatusForbidden, "http_request_denied", "blocked " + host, resp.BlockPage)
+}
+
+func (resp *Response)Failed(w http.ResponseWriter, host string, err error) {
+    code := http.StatusBadGateway
+    class := cluster.ErrProxyInternal
+    details := host
+    if f, ok := err.(*cluster.Failure); ok {
+	class = f.Class
+	if len(f.Tried) > 0 {
+	    details += " tried " + strings.Join(f.Tried, ",")
+	}
+    }
+    if class == cluster.ErrConnectionTimeout {
+	code = http.StatusGatewayTimeout
+    }
+    resp.write(w, code, class, details, resp.FailPage)
+}
@@ -0,0 +1,179 @@
+// go-multiproxier/upstream / sched.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+)
+
+// certcheck scheduler
+type Scheduler struct {
+    Interval time.Duration
+    Jitter time.Duration
+    intervals map[string]time.Duration // by CertHost
+    next map[*cluster.Cluster]time.Time
+    m *sync.Mutex
+}
+
+func NewScheduler() *Scheduler {
+    return &Scheduler{
+	Interval: 10 * time.Minute,
+	intervals: map[string]time.Duration{},
+	next: map[*cluster.Cluster]time.Time{},
+	m: new(sync.Mutex),
+    }
+}
+
+func parseInterval(s string) (time.Duration, error) {
+    d, err := time.ParseDuration(s)
+    if err == nil && d < time.Second {
+	err = errors.New("interval too short: " + s)
+    }
+    return d, err
+}
+
+// config line in [certcheck], "key=value" or "certhost:key=value"
+func (s *Scheduler)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad certcheck line: " + line)
+    }
+    key, val := l[0], l[1]
+    if c := strings.LastIndex(key, ":"); c > 0 {
+	if key[c+1:] != "interval" {
+	    return errors.New("unknown certcheck key: " + key)
+	}
+	d, err := parseInterval(val)
+	if err != nil {
+	    return err
+	}
+	s.SetClusterInterval(key[:c], d)
+	return nil
+    }
+    switch key {
+    case "interval":
+	d, err := parseInterval(val)
+	if err != nil {
+	    return err
+	}
+	s.SetInterval(d)
+    case "jitter":
+	d, err := time.ParseDuration(val)
+	if err != nil {
+	    return err
+	}
+	s.SetJitter(d)
+    case "probes":
+	n, err := strconv.Atoi(val)
+	if err != nil {
+	    return err
+	}
+	cluster.SetMaxProbes(n)
+    default:
+	return errors.New("unknown certcheck key: " + key)
+    }
+    return nil
+}
+
+func (s *Scheduler)SetInterval(d time.Duration) {
+    s.m.Lock()
+    s.Interval = d
+    s.m.Unlock()
+}
+
+func (s *Scheduler)SetJitter(d time.Duration) {
+    s.m.Lock()
+    s.Jitter = d
+    s.m.Unlock()
+}
+
+// SetClusterInterval sets the interval for a cluster, 0 means the default
+func (s *Scheduler)SetClusterInterval(certhost string, d time.Duration) {
+    s.m.Lock()
+    if d == 0 {
+	delete(s.intervals, certhost)
+    } else {
+	s.intervals[certhost] = d
+    }
+    s.m.Unlock()
+}
+
+func (s *Scheduler)interval(cl *cluster.Cluster) time.Duration {
+    if d, ok := s.intervals[cl.CertHost]; ok {
+	return d
+    }
+    return s.Interval
+}
+
+// Kick makes cl due
+func (s *Scheduler)Kick(cl *cluster.Cluster) {
+    s.m.Lock()
+    s.next[cl] = time.Time{}
+    s.m.Unlock()
+}
+
+func (s *Scheduler)KickAll() {
+    s.m.Lock()
+    for cl := range(s.next) {
+	s.next[cl] = time.Time{}
+    }
+    s.m.Unlock()
+}
+
+// Due returns clusters to be checked now and schedules the next check
+func (s *Scheduler)Due(clusters [](*cluster.Cluster), now time.Time) [](*cluster.Cluster) {
+    s.m.Lock()
+    defer s.m.Unlock()
+    due := [](*cluster.Cluster){}
+    next := map[*cluster.Cluster]time.Time{}
+    for _, cl := range(clusters) {
+	t, ok := s.next[cl]
+	if !ok {
+	    // spread the first checks over the interval, Kick for at once
+	    next[cl] = now.Add(time.Duration(rand.Int63n(int64(s.interval(cl)))))
+	    continue
+	}
+	if t.After(now) {
+	    next[cl] = t
+	    continue
+	}
+	t = now.Add(s.interval(cl))
+	if s.Jitter > 0 {
+	    t = t.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	next[cl] = t
+	due = append(due, cl)
+    }
+    // forget removed clusters
+    s.next = next
+    return due
+}
+
+func (s *Scheduler)Lines() []string {
+    s.m.Lock()
+    defer s.m.Unlock()
+    lines := []string{
+	fmt.Sprintf("interval %v", s.Interval),
+	fmt.Sprintf("jitter %v", s.Jitter),
+	fmt.Sprintf("probes %d", cluster.MaxProbes()),
+    }
+    next := []string{}
+    for cl, t := range(s.next) {
+	next = append(next, fmt.Sprintf("%s every %v next %s", cl.CertHost, s.interval(cl), t.Format(time.ANSIC)))
+    }
+    sort.Strings(next)
+    return append(lines, next...)
+}
@@ -7,6 +7,7 @@
 package upstream
 
 import (
+    "errors"
     "io"
     "net"
     "net/http"
@@ -15,22 +16,20 @@ import (
     "github.com/hshimamoto/go-multiproxier/cluster"
     "github.com/hshimamoto/go-multiproxier/connection"
     "github.com/hshimamoto/go-multiproxier/log"
-    "github.com/hshimamoto/go-multiproxier/outproxy"
     "github.com/hshimamoto/go-multiproxier/webhost"
 )
 
-func (up *Upstream)checkBlock(host string) bool {
+func (up *Upstream)blockHost(host string) *webhost.BlockHost {
     for _, d := range(up.BlockHosts) {
 	if d.Match(host) {
-	    d.Blocked++
-	    return true
+	    return d
 	}
     }
-    return false
+    return nil
 }
 
 func (up *Upstream)checkDirect(host string) bool {
-    for _, d := range(up.DirectHosts) {
+    for _, d := range(up.directHosts()) {
 	if d.Match(host) {
 	    return true
 	}
@@ -39,44 +38,50 @@ func (up *Upstream)checkDirect(host string) bool {
 }
 
 func (up *Upstream)lookupCluster(host string) *cluster.Cluster {
-    for _, cluster := range(up.Clusters) {
+    for _, cluster := range(up.clusters()) {
 	if cluster.Host.Match(host) {
 	    return cluster
 	}
     }
-    for _, cluster := range(up.TempClusters) {
+    if tcl := up.Temps.Lookup(host, up.DefaultCluster); tcl != nil {
+	return tcl
+    }
+    return up.DefaultCluster
+}
+
+// matchCluster is lookupCluster without a new temp cluster, nil if
+// lookupCluster would create one
+func (up *Upstream)matchCluster(host string) *cluster.Cluster {
+    for _, cluster := range(up.clusters()) {
 	if cluster.Host.Match(host) {
-	    cluster.Expire = time.Now().Add(time.Hour)
 	    return cluster
 	}
     }
-    if len(up.TempClusters) > 100 {
+    if tcl := up.Temps.Match(host); tcl != nil {
+	return tcl
+    }
+    if up.Temps.Capacity <= 0 {
 	return up.DefaultCluster
     }
-    // create temporary
-    tcl := cluster.New()
-    up.DefaultCluster.Lock()
-    for e := up.DefaultCluster.OutProxies.Front(); e != nil; e = e.Next() {
-	outproxy := e.Value.(*outproxy.OutProxy)
-	tcl.OutProxies.PushBack(outproxy)
-    }
-    up.DefaultCluster.Unlock()
-    tcl.Host = *webhost.NewWebHost(host)
-    tcl.CertHost = "Temporary for " + host
-    tcl.Expire = time.Now().Add(time.Hour)
-    up.TempClusters = append(up.TempClusters, tcl)
-    return tcl
+    return nil
 }
 
-func (up *Upstream)handleConnect(w http.ResponseWriter,r *http.Request) {
+func (up *Upstream)handleConnect(w http.ResponseWriter,r *http.Request, user string) {
     port := r.URL.Port()
     host := r.URL.Hostname()
-    if up.checkBlock(host) {
+    c := clientOfRequest(user, r)
+    if port == "443" && up.SNI.Route {
+	up.handleConnectSNI(w, r, c)
+	return
+    }
+    rt := up.decide(host, port, c, true)
+    logRoute(host, c, rt)
+    if rt.blocked {
 	log.Println("block " + host)
-	w.WriteHeader(http.StatusForbidden)
+	up.Response.Blocked(w, host)
 	return
     }
-    if port != "443" || up.checkDirect(host) {
+    if rt.direct {
 	log.Println("direct connection")
 	rconn, err := net.DialTimeout("tcp", up.MiddleAddr, 10 * time.Second)
 	if err != nil {
@@ -92,18 +97,36 @@ func (up *Upstream)handleConnect(w http.ResponseWriter,r *http.Request) {
 
 	r.WriteProxy(rconn)
 
-	connection.Transfer(lconn, rconn)
+	start := time.Now()
+	sent, received := connection.Transfer(lconn, rconn)
+	up.countDirect(sent, received)
+	up.account(directTunnel(host, sent, received, time.Since(start)), c)
 
 	return
     }
     // cluster
-    cluster := up.lookupCluster(host)
+    cluster := rt.cluster
     log.Println("cluster:", cluster)
 
-    cluster.Run(up.MiddleAddr, host, w, r)
+    t, err := cluster.Run(up.MiddleAddr, host, rt.pool, w, r)
+    if err != nil {
+	log.Println("cluster:", cluster, err)
+	up.Response.Failed(w, host, err)
+	return
+    }
+    up.account(t, c)
 }
 
-func (up *Upstream)handleHTTP(w http.ResponseWriter, r *http.Request) {
+func (up *Upstream)handleHTTP(w http.ResponseWriter, r *http.Request, user string) {
+    host := r.URL.Hostname()
+    c := clientOfRequest(user, r)
+    // live counts the block hit, port 80 never makes a temp cluster
+    rt := up.decide(host, "80", c, true)
+    if rt.blocked {
+	logRoute(host, c, rt)
+	up.Response.Blocked(w, host)
+	return
+    }
     conn, err := net.Dial("tcp", up.MiddleAddr) // Dial to upstream
     if err != nil {
 	log.Println("net.Dial:", err)
@@ -130,51 +153,149 @@ func (up *Upstream)handleHTTP(w http.ResponseWriter, r *http.Request) {
 func (up *Upstream)Handler(w http.ResponseWriter, r *http.Request) {
     log.Println(r.Method, r.URL)
 
+    if r.Method != http.MethodConnect && r.URL.Host == "" {
+	up.handleInBandAPI(w, r)
+	return
+    }
+
+    user, ok := up.checkAuth(w, r)
+    if !ok {
+	return
+    }
+
     if r.Method == http.MethodConnect {
-	up.handleConnect(w, r)
+	up.handleConnect(w, r, user)
     } else {
-	if r.URL.Host == "" {
-	    up.handleAPI(w, r)
-	} else {
-	    up.handleHTTP(w, r)
-	}
+	up.handleHTTP(w, r, user)
     }
 }
 
 func (up *Upstream)DoCertCheck() {
-    for _, cluster := range(up.Clusters) {
-	go cluster.CertCheck(up.MiddleAddr)
-	time.Sleep(time.Second)
-    }
+    up.Sched.KickAll()
 }
 
 func (up *Upstream)CertChecker() {
     for {
-	go up.DoCertCheck()
-	time.Sleep(up.CertCheckInterval)
+	for _, cluster := range(up.Sched.Due(up.clusters(), time.Now())) {
+	    go cluster.CertCheck(up.MiddleAddr)
+	}
+	time.Sleep(time.Second)
     }
 }
 
 func (up *Upstream)HouseKeeper() {
     for {
-	// TODO: NEED lock for temp cluster
-	plen := len(up.TempClusters)
-	tcls := [](*cluster.Cluster){}
-	for _, c := range(up.TempClusters) {
-	    if c.Expire.After(time.Now()) {
-		tcls = append(tcls, c)
-	    }
+	interval := 10 * time.Minute
+	if up.Temps.Idle < interval {
+	    interval = up.Temps.Idle
+	}
+	time.Sleep(interval)
+	n := up.Temps.Expire()
+	if n > 0 {
+	    log.Printf("HouseKeeper: expire %d temp clusters, %d left\n", n, up.Temps.Len())
 	}
-	up.TempClusters = tcls
-	if plen != len(tcls) {
-	    log.Printf("HouseKeeper: reduce temp clusters %d to %d\n", plen, len(tcls))
+    }
+}
+
+// serveConn accepts raw connections for handle
+func serveConn(name string, l net.Listener, handle func(net.Conn)) {
+    for {
+	conn, err := l.Accept()
+	if err != nil {
+	    log.Println(name, "accept:", err)
+	    if errors.Is(err, net.ErrClosed) {
+		return
+	    }
+	    time.Sleep(time.Second)
+	    continue
 	}
-	time.Sleep(10 * time.Minute)
+	go handle(conn)
     }
 }
 
-func (up *Upstream)Serve() {
+// Serve returns when a proxy listener fails
+func (up *Upstream)Serve() error {
+    if len(up.Listen) == 0 {
+	return errors.New("no address in [server]")
+    }
+    b := &binder{}
+    proxies := []net.Listener{}
+    for _, spec := range(up.Listen) {
+	l, err := b.listen("proxy", spec)
+	if err != nil {
+	    b.close()
+	    return err
+	}
+	proxies = append(proxies, filter("proxy", l, up.ACL.Proxy))
+    }
+    type rawListener struct {
+	name string
+	l net.Listener
+	handle func(net.Conn)
+    }
+    raws := []rawListener{}
+    bindRaw := func(name string, specs []string, handle func(net.Conn)) error {
+	for _, spec := range(specs) {
+	    l, err := b.listen(name, spec)
+	    if err != nil {
+		return err
+	    }
+	    l = filter(name, l, up.ACL.Proxy)
+	    raws = append(raws, rawListener{ name: name, l: l, handle: handle })
+	}
+	return nil
+    }
+    err := bindRaw("transparent", up.TransparentListen, up.handleTransparent)
+    if err == nil {
+	err = bindRaw("sniproxy", up.SNIListen, up.handleSNIProxy)
+    }
+    if err == nil {
+	err = bindRaw("socks", up.SOCKS.Listen, up.handleSOCKS)
+    }
+    if err != nil {
+	b.close()
+	return err
+    }
+    admins := []net.Listener{}
+    for _, spec := range(up.Admin.Listen) {
+	l, err := b.listen("api", spec)
+	if err != nil {
+	    b.close()
+	    return err
+	}
+	admins = append(admins, filter("api", l, up.ACL.API))
+    }
+    pcs := []net.PacketConn{}
+    for _, addr := range(up.DNS.Listen) {
+	pc, err := b.listenPacket("dns", addr)
+	if err != nil {
+	    b.close()
+	    return err
+	}
+	pcs = append(pcs, pc)
+    }
+
+    for _, raw := range(raws) {
+	go serveConn(raw.name, raw.l, raw.handle)
+    }
+    for _, l := range(admins) {
+	go func(l net.Listener) {
+	    err := http.Serve(l, http.HandlerFunc(up.AdminHandler))
+	    log.Println("api:", err)
+	}(l)
+    }
+    for _, pc := range(pcs) {
+	go up.serveDNS(pc)
+    }
     go up.CertChecker()
     go up.HouseKeeper()
-    http.ListenAndServe(up.Listen, http.HandlerFunc(up.Handler))
+    errc := make(chan error, len(proxies))
+    for _, l := range(proxies) {
+	go func(l net.Listener) {
+	    errc <- http.Serve(l, http.HandlerFunc(up.Handler))
+	}(l)
+    }
+    err = <-errc
+    b.close()
+    return err
 }
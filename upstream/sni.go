@@ -0,0 +1,164 @@
+// go-multiproxier/upstream / sni.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "errors"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/connection"
+    "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/sni"
+)
+
+var ErrBlocked = errors.New("blocked")
+
+// routing by TLS SNI for CONNECT
+type SNIOption struct {
+    Route bool
+    Strict bool // reject CONNECT host and SNI mismatch
+    Timeout time.Duration
+}
+
+func NewSNIOption() *SNIOption {
+    return &SNIOption{ Timeout: 10 * time.Second }
+}
+
+func onoff(s string) (bool, error) {
+    switch s {
+    case "on": return true, nil
+    case "off": return false, nil
+    }
+    return false, errors.New("need on or off: " + s)
+}
+
+// config line in [sni]
+func (o *SNIOption)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad sni line: " + line)
+    }
+    var err error
+    switch l[0] {
+    case "route":
+	o.Route, err = onoff(l[1])
+    case "strict":
+	o.Strict, err = onoff(l[1])
+    case "timeout":
+	o.Timeout, err = time.ParseDuration(l[1])
+    default:
+	err = errors.New("unknown sni key: " + l[0])
+    }
+    return err
+}
+
+// sniff reads ClientHello from lconn, host is empty if it is not TLS
+func (o *SNIOption)sniff(lconn net.Conn) (*sni.ClientHello, []byte) {
+    lconn.SetReadDeadline(time.Now().Add(o.Timeout))
+    hello, raw, err := sni.Read(lconn)
+    lconn.SetReadDeadline(time.Time{})
+    if err != nil {
+	log.Println("sni:", err)
+	return nil, raw
+    }
+    return hello, raw
+}
+
+// directConn connects lconn to host:port through the middle proxy
+func (up *Upstream)directConn(host, port string, c client, lconn net.Conn, preread []byte, ready func()) error {
+    rconn, err, _ := connection.OpenProxy(up.MiddleAddr, net.JoinHostPort(host, port))
+    if err != nil {
+	return err
+    }
+    defer rconn.Close()
+    if ready != nil {
+	ready()
+    }
+    rconn.Write(preread)
+    start := time.Now()
+    sent, received := connection.Transfer(lconn, rconn)
+    sent += int64(len(preread))
+    up.countDirect(sent, received)
+    up.account(directTunnel(host, sent, received, time.Since(start)), c)
+    return nil
+}
+
+// routeConn routes an accepted client connection which already got
+// its answer or gets it in ready, same as handleConnect
+func (up *Upstream)routeConn(host, port string, c client, lconn net.Conn, preread []byte, ready func()) error {
+    rt := up.decide(host, port, c, true)
+    logRoute(host, c, rt)
+    if rt.blocked {
+	log.Println("block " + host)
+	return ErrBlocked
+    }
+    if rt.direct {
+	log.Println("direct connection")
+	return up.directConn(host, port, c, lconn, preread, ready)
+    }
+    cluster := rt.cluster
+    log.Println("cluster:", cluster)
+    t, err := cluster.RunConn(up.MiddleAddr, host, port, rt.pool, lconn, preread, ready)
+    if err != nil {
+	return err
+    }
+    up.account(t, c)
+    return nil
+}
+
+func (up *Upstream)handleConnectSNI(w http.ResponseWriter, r *http.Request, c client) {
+    host := r.URL.Hostname()
+    port := r.URL.Port()
+    // no temp cluster yet, the SNI name may differ
+    if rt := up.decide(host, port, c, false); rt.blocked {
+	logRoute(host, c, rt)
+	up.Response.Blocked(w, host)
+	return
+    }
+
+    h, _ := w.(http.Hijacker)
+    lconn, _, err := h.Hijack()
+    if err != nil {
+	log.Println("hijack:", err)
+	return
+    }
+    defer lconn.Close()
+    lconn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+    hello, raw := up.SNI.sniff(lconn)
+    if hello != nil && hello.ServerName != "" && hello.ServerName != host {
+	log.Printf("sni: CONNECT %s but SNI %s ALPN %v\n", host, hello.ServerName, hello.ALPN)
+	if up.SNI.Strict && net.ParseIP(host) == nil {
+	    log.Println("sni: reject domain fronting to", hello.ServerName)
+	    return
+	}
+	host = hello.ServerName
+    }
+    err = up.routeConn(host, port, c, lconn, raw, nil)
+    if err != nil {
+	log.Println("sni:", host, err)
+    }
+}
+
+// handleSNIProxy serves raw TLS as if CONNECT to SNI:443 had arrived
+func (up *Upstream)handleSNIProxy(lconn net.Conn) {
+    defer lconn.Close()
+    hello, raw := up.SNI.sniff(lconn)
+    if hello == nil || hello.ServerName == "" {
+	log.Println("sniproxy: no SNI from", lconn.RemoteAddr())
+	return
+    }
+    host := hello.ServerName
+    log.Printf("sniproxy: %s to %s ALPN %v\n", lconn.RemoteAddr(), host, hello.ALPN)
+    err := up.routeConn(host, "443", clientOf("", lconn.RemoteAddr()), lconn, raw, nil)
+    if err != nil {
+	log.Println("sniproxy:", host, err)
+    }
+}
@@ -0,0 +1,109 @@
+// go-multiproxier/upstream / socks.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "crypto/subtle"
+    "errors"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/socks"
+)
+
+// SOCKS5 front-end
+type SOCKSOption struct {
+    Listen []string
+    Users map[string]string
+}
+
+func NewSOCKSOption() *SOCKSOption {
+    return &SOCKSOption{ Users: map[string]string{} }
+}
+
+// config line in [socks]
+func (o *SOCKSOption)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad socks line: " + line)
+    }
+    switch l[0] {
+    case "listen":
+	o.Listen = append(o.Listen, l[1])
+    case "user":
+	u := strings.SplitN(l[1], ":", 2)
+	if len(u) < 2 {
+	    return errors.New("bad socks user: " + l[1])
+	}
+	o.Users[u[0]] = u[1]
+    default:
+	return errors.New("unknown socks key: " + l[0])
+    }
+    return nil
+}
+
+// auth compares in constant time, unknown users take the same path
+func (o *SOCKSOption)auth(user, pass string) bool {
+    p, ok := o.Users[user]
+    eq := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+    return ok && eq
+}
+
+// socksCode maps routeConn errors to SOCKS reply codes
+func socksCode(err error) byte {
+    if err == ErrBlocked {
+	return socks.NotAllowed
+    }
+    var f *cluster.Failure
+    if errors.As(err, &f) {
+	switch f.Class {
+	case cluster.ErrConnectionTimeout, cluster.ErrDestinationUnavailable:
+	    return socks.HostUnreachable
+	}
+	return socks.GeneralFailure
+    }
+    var ne net.Error
+    if errors.As(err, &ne) && ne.Timeout() {
+	return socks.HostUnreachable
+    }
+    return socks.GeneralFailure
+}
+
+func (up *Upstream)handleSOCKS(lconn net.Conn) {
+    defer lconn.Close()
+    var auth func(user, pass string) bool
+    if len(up.SOCKS.Users) > 0 || up.Auth.Enabled() {
+	auth = func(user, pass string) bool {
+	    if up.SOCKS.auth(user, pass) {
+		return true
+	    }
+	    return up.Auth.Enabled() && up.Auth.Users.Check(user, pass)
+	}
+    }
+    lconn.SetReadDeadline(time.Now().Add(30 * time.Second))
+    user, host, port, err := socks.Handshake(lconn, auth)
+    lconn.SetReadDeadline(time.Time{})
+    if err != nil {
+	log.Println("socks:", lconn.RemoteAddr(), err)
+	return
+    }
+    log.Printf("socks: %s to %s:%s\n", lconn.RemoteAddr(), host, port)
+    replied := false
+    err = up.routeConn(host, port, clientOf(user, lconn.RemoteAddr()), lconn, nil, func() {
+	replied = true
+	socks.Reply(lconn, socks.Succeeded)
+    })
+    if err != nil {
+	log.Println("socks:", host, err)
+	if !replied {
+	    socks.Reply(lconn, socksCode(err))
+	}
+    }
+}
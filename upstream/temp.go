@@ -0,0 +1,199 @@
+// go-multiproxier/upstream / temp.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "container/list"
+    "errors"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/outproxy"
+    "github.com/hshimamoto/go-multiproxier/webhost"
+)
+
+// temporary clusters in LRU order, front is the most recently used
+type TempClusters struct {
+    lru *list.List
+    m *sync.Mutex
+    Capacity int
+    Idle time.Duration
+    restore []string
+    // shared by every temp cluster
+    Stats *cluster.Stats
+}
+
+func NewTempClusters() *TempClusters {
+    return &TempClusters{
+	lru: list.New(),
+	m: new(sync.Mutex),
+	Capacity: 100,
+	Idle: time.Hour,
+	Stats: cluster.NewStats(),
+    }
+}
+
+// config line in [temp]
+func (t *TempClusters)Set(line string) error {
+    l := strings.SplitN(line, "=", 2)
+    if len(l) < 2 {
+	return errors.New("bad temp line: " + line)
+    }
+    var err error
+    switch l[0] {
+    case "capacity":
+	t.Capacity, err = strconv.Atoi(l[1])
+    case "host":
+	// saved temp cluster
+	t.restore = append(t.restore, l[1])
+    case "expire":
+	t.Idle, err = time.ParseDuration(l[1])
+	if err == nil && t.Idle <= 0 {
+	    err = errors.New("bad temp expire: " + l[1])
+	}
+    default:
+	err = errors.New("unknown temp key: " + l[0])
+    }
+    return err
+}
+
+// Lookup returns the temp cluster for host, a new one is created with
+// outproxies of dc if there is none. nil if temp clusters are disabled.
+func (t *TempClusters)Lookup(host string, dc *cluster.Cluster) *cluster.Cluster {
+    t.m.Lock()
+    defer t.m.Unlock()
+    now := time.Now()
+    for e := t.lru.Front(); e != nil; e = e.Next() {
+	tcl := e.Value.(*cluster.Cluster)
+	if tcl.Host.Match(host) {
+	    tcl.Expire = now.Add(t.Idle)
+	    t.lru.MoveToFront(e)
+	    return tcl
+	}
+    }
+    if t.Capacity <= 0 {
+	return nil
+    }
+    // create temporary
+    tcl := cluster.New()
+    tcl.Stats = t.Stats
+    dc.Lock()
+    for e := dc.OutProxies.Front(); e != nil; e = e.Next() {
+	outproxy := e.Value.(*outproxy.OutProxy)
+	tcl.OutProxies.PushBack(outproxy)
+    }
+    dc.Unlock()
+    tcl.Host = *webhost.NewWebHost(host)
+    tcl.CertHost = "Temporary for " + host
+    tcl.Expire = now.Add(t.Idle)
+    t.lru.PushFront(tcl)
+    for t.lru.Len() > t.Capacity {
+	old := t.lru.Remove(t.lru.Back()).(*cluster.Cluster)
+	log.Println("temp cluster evicted:", old)
+    }
+    return tcl
+}
+
+// Expire removes idle temp clusters and returns the number of removed ones
+func (t *TempClusters)Expire() int {
+    t.m.Lock()
+    defer t.m.Unlock()
+    now := time.Now()
+    n := 0
+    e := t.lru.Front()
+    for e != nil {
+	next := e.Next()
+	if !e.Value.(*cluster.Cluster).Expire.After(now) {
+	    t.lru.Remove(e)
+	    n++
+	}
+	e = next
+    }
+    return n
+}
+
+func (t *TempClusters)Len() int {
+    t.m.Lock()
+    defer t.m.Unlock()
+    return t.lru.Len()
+}
+
+// List returns a snapshot
+func (t *TempClusters)List() [](*cluster.Cluster) {
+    t.m.Lock()
+    defer t.m.Unlock()
+    tcls := [](*cluster.Cluster){}
+    for e := t.lru.Front(); e != nil; e = e.Next() {
+	tcls = append(tcls, e.Value.(*cluster.Cluster))
+    }
+    return tcls
+}
+
+func (t *TempClusters)Find(host string) *cluster.Cluster {
+    t.m.Lock()
+    defer t.m.Unlock()
+    for e := t.lru.Front(); e != nil; e = e.Next() {
+	tcl := e.Value.(*cluster.Cluster)
+	if tcl.CertHost == "Temporary for " + host {
+	    return tcl
+	}
+    }
+    return nil
+}
+
+// Remove reports whether tcl was in the list
+func (t *TempClusters)Remove(tcl *cluster.Cluster) bool {
+    t.m.Lock()
+    defer t.m.Unlock()
+    for e := t.lru.Front(); e != nil; e = e.Next() {
+	if e.Value.(*cluster.Cluster) == tcl {
+	    t.lru.Remove(e)
+	    return true
+	}
+    }
+    return false
+}
+
+// Match is Lookup without touching the LRU
+func (t *TempClusters)Match(host string) *cluster.Cluster {
+    t.m.Lock()
+    defer t.m.Unlock()
+    for e := t.lru.Front(); e != nil; e = e.Next() {
+	tcl := e.Value.(*cluster.Cluster)
+	if tcl.Host.Match(host) {
+	    return tcl
+	}
+    }
+    return nil
+}
+
+// Restore creates the saved temp clusters, oldest first
+func (t *TempClusters)Restore(dc *cluster.Cluster) {
+    for i := len(t.restore) - 1; i >= 0; i-- {
+	t.Lookup(t.restore[i], dc)
+    }
+    t.restore = nil
+}
+
+// config lines in [temp], the most recently used host first
+func (t *TempClusters)ConfigLines() []string {
+    lines := []string{}
+    if t.Capacity != 100 {
+	lines = append(lines, "capacity=" + strconv.Itoa(t.Capacity))
+    }
+    if t.Idle != time.Hour {
+	lines = append(lines, "expire=" + t.Idle.String())
+    }
+    for _, tcl := range(t.List()) {
+	lines = append(lines, "host=" + tcl.Host.String())
+    }
+    return lines
+}
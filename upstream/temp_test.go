@@ -0,0 +1,73 @@
+// go-multiproxier/upstream / temp_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+)
+
+func TestTempClustersLRU(t *testing.T) {
+    dc := cluster.New()
+    tc := NewTempClusters()
+    tc.Capacity = 2
+    a := tc.Lookup("a.example.com", dc)
+    tc.Lookup("b.example.com", dc)
+    if tc.Lookup("a.example.com", dc) != a {
+	t.Fatalf("a.example.com got a new temp cluster")
+    }
+    // b is the least recently used
+    tc.Lookup("c.example.com", dc)
+    if tc.Find("b.example.com") != nil {
+	t.Errorf("b.example.com is not evicted")
+    }
+    if l := tc.List(); len(l) != 2 || l[0].Host.String() != "c.example.com" || l[1] != a {
+	t.Errorf("bad LRU order %v", l)
+    }
+}
+
+func TestTempClustersConcurrent(t *testing.T) {
+    dc := cluster.New()
+    tc := NewTempClusters()
+    tc.Capacity = 8
+    tc.Idle = time.Millisecond
+    var wg sync.WaitGroup
+    for i := 0; i < 16; i++ {
+	wg.Add(1)
+	go func(i int) {
+	    defer wg.Done()
+	    for j := 0; j < 100; j++ {
+		host := fmt.Sprintf("h%d.example.com", (i * j) % 20)
+		tcl := tc.Lookup(host, dc)
+		if tcl == nil || !tcl.Host.Match(host) {
+		    t.Errorf("Lookup %s got %v", host, tcl)
+		    return
+		}
+		tc.Match(host)
+		if j % 10 == 0 {
+		    tc.Expire()
+		    tc.Remove(tcl)
+		}
+		if n := tc.Len(); n > tc.Capacity {
+		    t.Errorf("%d temp clusters over capacity %d", n, tc.Capacity)
+		}
+		tc.List()
+		tc.Find(host)
+	    }
+	}(i)
+    }
+    wg.Wait()
+    time.Sleep(2 * time.Millisecond)
+    tc.Expire()
+    if n := tc.Len(); n != 0 {
+	t.Errorf("%d temp clusters left after expire", n)
+    }
+}
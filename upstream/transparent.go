@@ -0,0 +1,75 @@
+// go-multiproxier/upstream / transparent.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/log"
+    "github.com/hshimamoto/go-multiproxier/sni"
+    "github.com/hshimamoto/go-multiproxier/transparent"
+)
+
+// sniffHost returns the host name in TLS SNI or HTTP Host header and
+// every byte read from lconn
+func (up *Upstream)sniffHost(lconn net.Conn) (string, []byte) {
+    lconn.SetReadDeadline(time.Now().Add(up.SNI.Timeout))
+    defer lconn.SetReadDeadline(time.Time{})
+    hello, raw, err := sni.Read(lconn)
+    if err == nil {
+	return hello.ServerName, raw
+    }
+    if err != sni.ErrNotTLS {
+	log.Println("sni:", err)
+	return "", raw
+    }
+    // HTTP
+    var buf bytes.Buffer
+    rd := bufio.NewReader(io.TeeReader(io.MultiReader(bytes.NewReader(raw), lconn), &buf))
+    req, err := http.ReadRequest(rd)
+    if err != nil {
+	log.Println("http:", err)
+	return "", buf.Bytes()
+    }
+    host := req.Host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+	host = h
+    }
+    return host, buf.Bytes()
+}
+
+func (up *Upstream)handleTransparent(lconn net.Conn) {
+    defer lconn.Close()
+    tconn, ok := lconn.(*net.TCPConn)
+    if !ok {
+	return
+    }
+    dst, err := transparent.OriginalDst(tconn)
+    if err != nil {
+	log.Println("transparent:", err)
+	return
+    }
+    if dst.String() == lconn.LocalAddr().String() {
+	log.Println("transparent: not redirected", lconn.RemoteAddr())
+	return
+    }
+    host, raw := up.sniffHost(lconn)
+    if host == "" {
+	host = dst.IP.String()
+    }
+    log.Printf("transparent: %s to %v %s\n", lconn.RemoteAddr(), dst, host)
+    err = up.routeConn(host, strconv.Itoa(dst.Port), clientOf("", lconn.RemoteAddr()), lconn, raw, nil)
+    if err != nil {
+	log.Println("transparent:", host, err)
+    }
+}
@@ -7,35 +7,71 @@
 package upstream
 
 import (
+    "errors"
     "io/ioutil"
     "os"
     "strings"
+    "sync"
     "time"
 
     "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/connection"
     "github.com/hshimamoto/go-multiproxier/log"
     "github.com/hshimamoto/go-multiproxier/outproxy"
     "github.com/hshimamoto/go-multiproxier/webhost"
 )
 
 type Upstream struct {
-    Listen string
+    Listen []string
+    TransparentListen []string
+    SNIListen []string
     MiddleAddr string
     Clusters [](*cluster.Cluster)
-    TempClusters [](*cluster.Cluster)
+    Temps *TempClusters
     DefaultCluster *cluster.Cluster
     DirectHosts [](*webhost.WebHost)
     BlockHosts [](*webhost.BlockHost)
+    Policies [](*Policy)
+    Response *Response
+    SNI *SNIOption
+    DNS *DNSOption
+    SOCKS *SOCKSOption
+    Auth *AuthOption
+    ACL *ACLOption
+    Admin *AdminOption
     //
-    CertCheckInterval time.Duration
+    Sched *Scheduler
+    DirectStats *cluster.Stats
+    Usage *UsageTable
+    m *sync.Mutex
+    // config file
+    path string
+    config *Config
+    loaded map[string][]string
+    probes map[string][]string // [probe] lines by CertHost
+    saveM *sync.Mutex
 }
 
 func NewUpstream(path string) (*Upstream, error) {
     up := &Upstream{}
+    up.m = new(sync.Mutex)
+    up.saveM = new(sync.Mutex)
+    up.path = path
+    up.probes = map[string][]string{}
     up.DirectHosts = [](*webhost.WebHost){}
     up.BlockHosts = [](*webhost.BlockHost){}
     up.Clusters = [](*cluster.Cluster){}
-    up.TempClusters = [](*cluster.Cluster){}
+    up.Temps = NewTempClusters()
+    up.Response = NewResponse()
+    up.Sched = NewScheduler()
+    up.DirectStats = cluster.NewStats()
+    up.Usage = NewUsageTable()
+    up.SNI = NewSNIOption()
+    up.DNS = NewDNSOption()
+    up.SOCKS = NewSOCKSOption()
+    up.Auth = NewAuthOption()
+    up.ACL = NewACLOption()
+    up.Admin = NewAdminOption()
 
     f, err := os.Open(path)
     if err != nil {
@@ -48,11 +84,13 @@ func NewUpstream(path string) (*Upstream, error) {
 	return nil, err
     }
 
+    up.config = ParseConfig(string(config))
     lines := strings.Split(string(config), "\n")
     key := ""
     proxies := [](*outproxy.OutProxy){}
     wilds := [](*cluster.Cluster){}
     nowilds := [](*cluster.Cluster){}
+    probes := map[string](*connection.Probe){}
     now := time.Now()
     for _, line := range(lines) {
 	if line == "" || line[0] == '#' {
@@ -64,14 +102,31 @@ func NewUpstream(path string) (*Upstream, error) {
 	}
 	switch key {
 	case "[server]":
-	    up.Listen = line
+	    up.Listen = append(up.Listen, line)
 	case "[upstream]":
-	    proxies = append(proxies, &outproxy.OutProxy{
-		Addr: line,
+	    // addr [pool,...] [disabled]
+	    f := strings.Fields(line)
+	    if len(f) == 0 {
+		continue
+	    }
+	    outer := &outproxy.OutProxy{
+		Addr: f[0],
 		Bad: now,
 		Timeout: 15 * time.Second,
 		NumRunning: 0,
-	    })
+	    }
+	    for _, opt := range(f[1:]) {
+		if opt == "disabled" {
+		    outer.SetDisabled(true)
+		} else {
+		    outer.Pools = strings.Split(opt, ",")
+		}
+	    }
+	    proxies = append(proxies, outer)
+	case "[transparent]":
+	    up.TransparentListen = append(up.TransparentListen, line)
+	case "[sniproxy]":
+	    up.SNIListen = append(up.SNIListen, line)
 	case "[proxy]":
 	    up.MiddleAddr = line
 	case "[direct]":
@@ -88,6 +143,85 @@ func NewUpstream(path string) (*Upstream, error) {
 	    }
 	case "[block]":
 	    up.BlockHosts = append(up.BlockHosts, webhost.NewBlockHost(line))
+	case "[probe]":
+	    // certhost:key=value
+	    l := strings.SplitN(line, ":", 2)
+	    if len(l) < 2 {
+		return nil, errors.New("bad probe line: " + line)
+	    }
+	    p, ok := probes[l[0]]
+	    if !ok {
+		p = connection.DefaultProbe(l[0])
+		probes[l[0]] = p
+	    }
+	    if err := p.Set(l[1]); err != nil {
+		return nil, err
+	    }
+	    up.probes[l[0]] = append(up.probes[l[0]], l[1])
+	case "[certcheck]":
+	    if err := up.Sched.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[sni]":
+	    if err := up.SNI.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[dns]":
+	    if err := up.DNS.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[socks]":
+	    if err := up.SOCKS.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[auth]":
+	    if err := up.Auth.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[api]":
+	    if err := up.Admin.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[acl]":
+	    if err := up.ACL.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[policy]":
+	    // name:key=value
+	    l := strings.SplitN(line, ":", 2)
+	    if len(l) < 2 {
+		return nil, errors.New("bad policy line: " + line)
+	    }
+	    p := up.findPolicy(l[0])
+	    if p == nil {
+		p = &Policy{ Name: l[0] }
+		up.Policies = append(up.Policies, p)
+	    }
+	    if err := p.Set(l[1]); err != nil {
+		return nil, err
+	    }
+	case "[temp]":
+	    if err := up.Temps.Set(line); err != nil {
+		return nil, err
+	    }
+	case "[response]":
+	    if err := up.Response.Set(line); err != nil {
+		return nil, err
+	    }
+	}
+    }
+    for _, p := range(up.Policies) {
+	if p.Pool == "" {
+	    continue
+	}
+	found := false
+	for _, proxy := range(proxies) {
+	    if proxy.InPool(p.Pool) {
+		found = true
+	    }
+	}
+	if !found {
+	    return nil, errors.New("policy " + p.Name + ": no outproxy in pool " + p.Pool)
 	}
     }
     up.Clusters = append(nowilds, wilds...)
@@ -96,6 +230,10 @@ func NewUpstream(path string) (*Upstream, error) {
 	    cluster.OutProxies.PushBack(proxy)
 	}
 	cluster.CertOK = nil
+	cluster.Probe = probes[cluster.CertHost]
+	if cluster.Probe == nil {
+	    cluster.Probe = connection.DefaultProbe(cluster.CertHost)
+	}
 	log.Println("cluster:", cluster)
     }
     up.DefaultCluster = cluster.New()
@@ -104,8 +242,113 @@ func NewUpstream(path string) (*Upstream, error) {
 	up.DefaultCluster.OutProxies.PushBack(proxy)
     }
     log.Println("default cluster:", up.DefaultCluster)
-    // fast certcheck
-    up.CertCheckInterval = 10 * time.Minute
-
+    up.Admin.finish()
+    if err := up.DNS.check(); err != nil {
+	return nil, err
+    }
+    up.Temps.Restore(up.DefaultCluster)
+    up.baseline()
     return up, nil
 }
+
+// clusters returns a snapshot of Clusters
+func (up *Upstream)clusters() [](*cluster.Cluster) {
+    up.m.Lock()
+    defer up.m.Unlock()
+    return append([](*cluster.Cluster){}, up.Clusters...)
+}
+
+func (up *Upstream)findCluster(name string) *cluster.Cluster {
+    for _, c := range(up.clusters()) {
+	if c.CertHost == name {
+	    return c
+	}
+    }
+    return nil
+}
+
+// addCluster keeps wildcard clusters after the others
+func (up *Upstream)addCluster(cl *cluster.Cluster) error {
+    up.m.Lock()
+    defer up.m.Unlock()
+    return up.insertCluster(cl)
+}
+
+// under up.m
+func (up *Upstream)insertCluster(cl *cluster.Cluster) error {
+    pos := 0
+    for i, c := range(up.Clusters) {
+	if c.CertHost == cl.CertHost {
+	    return errors.New("cluster exists: " + cl.CertHost)
+	}
+	if cl.Host.Wild || !c.Host.Wild {
+	    pos = i + 1
+	}
+    }
+    clusters := append([](*cluster.Cluster){}, up.Clusters[:pos]...)
+    clusters = append(clusters, cl)
+    up.Clusters = append(clusters, up.Clusters[pos:]...)
+    return nil
+}
+
+// under up.m
+func (up *Upstream)dropCluster(cl *cluster.Cluster) bool {
+    for i, c := range(up.Clusters) {
+	if c == cl {
+	    clusters := append([](*cluster.Cluster){}, up.Clusters[:i]...)
+	    up.Clusters = append(clusters, up.Clusters[i + 1:]...)
+	    return true
+	}
+    }
+    return false
+}
+
+// promote moves the temp cluster for host into Clusters
+func (up *Upstream)promote(host, certhost, pattern string) (*cluster.Cluster, error) {
+    tcl := up.Temps.Find(host)
+    if tcl == nil {
+	return nil, errors.New("no temp cluster for " + host)
+    }
+    if certhost == "" {
+	certhost = host
+    }
+    if up.findCluster(certhost) != nil {
+	return nil, errors.New("cluster exists: " + certhost)
+    }
+    wh := tcl.Host
+    if pattern != "" {
+	wh = *webhost.NewWebHost(pattern)
+	if !wh.Match(host) {
+	    return nil, errors.New(pattern + " does not match " + host)
+	}
+    }
+    // tunnels in tcl still read it
+    cl := tcl.Copy()
+    cl.CertHost = certhost
+    cl.Host = wh
+    cl.CertOK = nil
+    cl.Probe = connection.DefaultProbe(certhost)
+    cl.Expire = time.Time{}
+    cl.Stats = cluster.NewStats()
+    // the temp cluster stays on failure
+    if err := up.addCluster(cl); err != nil {
+	return nil, err
+    }
+    if !up.Temps.Remove(tcl) {
+	up.m.Lock()
+	up.dropCluster(cl)
+	up.m.Unlock()
+	return nil, errors.New("temp cluster gone: " + host)
+    }
+    log.Println("promote cluster:", cl)
+    return cl, nil
+}
+
+func (up *Upstream)findPolicy(name string) *Policy {
+    for _, p := range(up.Policies) {
+	if p.Name == name {
+	    return p
+	}
+    }
+    return nil
+}
@@ -0,0 +1,172 @@
+// go-multiproxier/upstream / usage.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "container/list"
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+    "github.com/hshimamoto/go-multiproxier/log"
+)
+
+// Usage is the rollup of finished tunnels
+type Usage struct {
+    Tunnels uint64 `json:"tunnels"`
+    Sent int64 `json:"sent"`
+    Received int64 `json:"received"`
+    Seconds float64 `json:"seconds"`
+    Longest float64 `json:"longest_seconds"`
+    Last time.Time `json:"last"`
+}
+
+func (u *Usage)add(t *cluster.Tunnel, now time.Time) {
+    d := t.Duration.Seconds()
+    u.Tunnels++
+    u.Sent += t.Sent
+    u.Received += t.Received
+    u.Seconds += d
+    if d > u.Longest {
+	u.Longest = d
+    }
+    u.Last = now
+}
+
+var usageKinds = []string{ "outproxy", "cluster", "host", "client" }
+
+// usages of a kind, the most recently used first
+type usageList struct {
+    lru *list.List
+    keys map[string]*list.Element
+}
+
+type usageEntry struct {
+    key string
+    usage Usage
+}
+
+// UsageTable rolls up tunnels by kind, each kind keeps at most Limit
+// keys and forgets the least recently used one
+type UsageTable struct {
+    Limit int
+    tables map[string]*usageList
+    m sync.Mutex
+}
+
+func NewUsageTable() *UsageTable {
+    u := &UsageTable{ Limit: 1000, tables: map[string]*usageList{} }
+    for _, kind := range(usageKinds) {
+	u.tables[kind] = &usageList{ lru: list.New(), keys: map[string]*list.Element{} }
+    }
+    return u
+}
+
+func (u *UsageTable)add(kind, key string, t *cluster.Tunnel, now time.Time) {
+    table := u.tables[kind]
+    e, ok := table.keys[key]
+    if ok {
+	table.lru.MoveToFront(e)
+    } else {
+	for table.lru.Len() >= u.Limit {
+	    oldest := table.lru.Back()
+	    table.lru.Remove(oldest)
+	    delete(table.keys, oldest.Value.(*usageEntry).key)
+	}
+	e = table.lru.PushFront(&usageEntry{ key: key })
+	table.keys[key] = e
+    }
+    e.Value.(*usageEntry).usage.add(t, now)
+}
+
+func (u *UsageTable)Add(t *cluster.Tunnel, c client) {
+    who := c.user
+    if who == "" {
+	who = c.ip.String()
+    }
+    now := time.Now()
+    u.m.Lock()
+    u.add("outproxy", t.OutProxy, t, now)
+    u.add("cluster", t.Cluster, t, now)
+    u.add("host", t.Host, t, now)
+    u.add("client", who, t, now)
+    u.m.Unlock()
+}
+
+// Get returns a copy, nil for an unknown kind
+func (u *UsageTable)Get(kind string) map[string]Usage {
+    u.m.Lock()
+    defer u.m.Unlock()
+    table, ok := u.tables[kind]
+    if !ok {
+	return nil
+    }
+    usages := map[string]Usage{}
+    for e := table.lru.Front(); e != nil; e = e.Next() {
+	ue := e.Value.(*usageEntry)
+	usages[ue.key] = ue.usage
+    }
+    return usages
+}
+
+// Lines are sorted by bytes, the largest first
+func (u *UsageTable)Lines(kind string) []string {
+    usages := u.Get(kind)
+    keys := []string{}
+    for k := range(usages) {
+	keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+	a, b := usages[keys[i]], usages[keys[j]]
+	return a.Sent + a.Received > b.Sent + b.Received
+    })
+    lines := []string{}
+    for _, k := range(keys) {
+	v := usages[k]
+	lines = append(lines, fmt.Sprintf("%s %d tunnels sent %d received %d time %.1fs longest %.1fs",
+	    k, v.Tunnels, v.Sent, v.Received, v.Seconds, v.Longest))
+    }
+    return lines
+}
+
+func directTunnel(host string, sent, received int64, d time.Duration) *cluster.Tunnel {
+    return &cluster.Tunnel{
+	Cluster: "direct",
+	OutProxy: "direct",
+	Host: host,
+	Sent: sent,
+	Received: received,
+	Duration: d,
+    }
+}
+
+// account records a finished tunnel
+func (up *Upstream)account(t *cluster.Tunnel, c client) {
+    log.Printf("tunnel %s for %s via %s/%s sent %d received %d in %v\n",
+	t.Host, c, t.Cluster, t.OutProxy, t.Sent, t.Received, t.Duration)
+    up.Usage.Add(t, c)
+}
+
+// usage/<outproxy|cluster|host|client>, usage/ lists the kinds
+func (up *Upstream)apiUsage(api []string, w http.ResponseWriter, r *http.Request) {
+    if len(api) < 1 || api[0] == "" {
+	for _, kind := range(usageKinds) {
+	    w.Write([]byte(kind + "\n"))
+	}
+	return
+    }
+    if up.Usage.Get(api[0]) == nil {
+	http.NotFound(w, r)
+	return
+    }
+    for _, line := range(up.Usage.Lines(api[0])) {
+	w.Write([]byte(line + "\n"))
+    }
+}
@@ -0,0 +1,38 @@
+// go-multiproxier/upstream / usage_test.go
+//
+// MIT License Copyright(c) 2018 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+
+package upstream
+
+import (
+    "net"
+    "testing"
+
+    "github.com/hshimamoto/go-multiproxier/cluster"
+)
+
+func TestUsageTableLRU(t *testing.T) {
+    u := NewUsageTable()
+    u.Limit = 2
+    c := client{ ip: net.ParseIP("127.0.0.1") }
+    tunnel := func(host string) *cluster.Tunnel {
+	return &cluster.Tunnel{ Cluster: "c", OutProxy: "o", Host: host, Sent: 1 }
+    }
+    u.Add(tunnel("a.com"), c)
+    u.Add(tunnel("b.com"), c)
+    u.Add(tunnel("a.com"), c)
+    // b.com is the least recently used
+    u.Add(tunnel("c.com"), c)
+    hosts := u.Get("host")
+    if _, ok := hosts["b.com"]; ok || len(hosts) != 2 {
+	t.Errorf("bad hosts %v", hosts)
+    }
+    if hosts["a.com"].Tunnels != 2 {
+	t.Errorf("a.com has %d tunnels", hosts["a.com"].Tunnels)
+    }
+    if u.Get("nope") != nil {
+	t.Errorf("unknown kind has usages")
+    }
+}
@@ -52,8 +52,8 @@ func (wh *WebHost)Match(host string) bool {
 }
 
 type BlockHost struct {
+    Blocked uint64 // atomic, first for 64-bit alignment on 32-bit targets
     wh *WebHost
-    Blocked int
 }
 
 func (bh *BlockHost)String() string {